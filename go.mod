@@ -2,6 +2,8 @@ module mesher
 
 go 1.23.4
 
+require golang.org/x/net v0.35.0
+
 require (
 	github.com/ebitengine/purego v0.8.2 // indirect
 	github.com/gen2brain/raylib-go/raylib v0.0.0-20250215042252-db8e47f0e5c5 // indirect
@@ -0,0 +1,144 @@
+package mesher
+
+import (
+	"net"
+	"time"
+)
+
+/******************************************************************************/
+/* ACKS                                                                       */
+/******************************************************************************/
+
+// Acknowledges data with Seq, sent directly to the data's sender.
+type dataAck struct {
+	Seq uint64
+}
+
+func (m dataAck) updatePeer(p *peer, from *net.UDPAddr, replies chan response,
+	data chan PeerMsg) {
+	p.acked(addrKey(from), m.Seq)
+}
+
+// Asks the server to pass an acknowledgement on to To.
+type ackRelayTo struct {
+	To  address
+	Seq uint64
+}
+
+func (m ackRelayTo) updateServer(s *server, from *net.UDPAddr,
+	replies chan response) {
+	if !s.registered(from) {
+		return
+	}
+	if _, ok := s.peers[m.To]; ok {
+		replies <- response{
+			to: addrFromKey(m.To),
+			m:  ackRelayedFrom{addrKey(from), m.Seq},
+		}
+	}
+}
+
+type ackRelayedFrom struct {
+	From address
+	Seq  uint64
+}
+
+func (m ackRelayedFrom) updatePeer(p *peer, from *net.UDPAddr,
+	replies chan response, data chan PeerMsg) {
+	if addrKey(from) != addrKey(p.server) {
+		p.logWarn("ignoring ackRelayedFrom from", from, "not the server")
+		return
+	}
+	p.acked(m.From, m.Seq)
+}
+
+// Acknowledges data with seq to a, the way data to a would go.
+func (p *peer) ack(a address, seq uint64, replies chan response) {
+	if p.direct(a) || p.server == nil {
+		replies <- response{to: addrFromKey(a), m: dataAck{seq}}
+		return
+	}
+	replies <- response{to: p.server, m: ackRelayTo{a, seq}}
+}
+
+// A broadcast awaiting acknowledgements, see PeerHandle.BroadcastAcked.
+type ackWindow struct {
+	// Sequence numbers of the data to each peer yet to acknowledge it.
+	pending   map[address]uint64
+	delivered int
+	total     int
+	deadline  time.Time
+}
+
+// Called for data with seq sent to a as part of broadcast ack.
+func (p *peer) awaitAck(ack uint64, a address, seq uint64) {
+	w := p.ackWindows[ack]
+	w.pending[a] = seq
+	w.total += 1
+	if p.ackSeqs[a] == nil {
+		p.ackSeqs[a] = make(map[uint64]uint64)
+	}
+	p.ackSeqs[a][seq] = ack
+}
+
+func (p *peer) acked(a address, seq uint64) {
+	ack, ok := p.ackSeqs[a][seq]
+	if !ok {
+		return
+	}
+	delete(p.ackSeqs[a], seq)
+	w := p.ackWindows[ack]
+	delete(w.pending, a)
+	w.delivered += 1
+	if p.config.OnDelivered != nil {
+		p.config.OnDelivered(ack, p.peerIds[a])
+	}
+	if len(w.pending) == 0 {
+		p.completeAck(ack)
+	}
+}
+
+func (p *peer) completeAck(ack uint64) {
+	w := p.ackWindows[ack]
+	for a, seq := range w.pending {
+		delete(p.ackSeqs[a], seq)
+	}
+	delete(p.ackWindows, ack)
+	if p.config.OnBroadcastComplete != nil {
+		p.config.OnBroadcastComplete(ack, w.delivered, w.total)
+	}
+}
+
+// Completes broadcasts whose acknowledgements are overdue.
+func (p *peer) expireAcks() {
+	for ack, w := range p.ackWindows {
+		if p.config.Clock.Now().After(w.deadline) {
+			p.completeAck(ack)
+		}
+	}
+}
+
+// Broadcasts data like the broadcast channel, asking every peer to
+// acknowledge it. Returns the sequence number OnDelivered and
+// OnBroadcastComplete report the broadcast with.
+func (h *PeerHandle) BroadcastAcked(data []byte) (uint64, error) {
+	var ack uint64
+	var err error
+	ok := h.do(func(p *peer) {
+		p.broadcastSeq += 1
+		ack = p.broadcastSeq
+		p.ackWindows[ack] = &ackWindow{
+			pending:  make(map[address]uint64),
+			deadline: p.config.Clock.Now().Add(p.config.AckTimeout),
+		}
+		p.active(p.responses)
+		err = p.broadcast(outgoing{buf: data, ack: ack}, p.responses)
+		if len(p.ackWindows[ack].pending) == 0 {
+			p.completeAck(ack)
+		}
+	})
+	if !ok {
+		return 0, ErrStopped
+	}
+	return ack, err
+}
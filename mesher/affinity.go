@@ -0,0 +1,115 @@
+package mesher
+
+import (
+	"time"
+)
+
+/******************************************************************************/
+/* AFFINITY                                                                   */
+/******************************************************************************/
+
+const (
+	// Unanswered keep-alives after which a peer is only relayed to, and for
+	// how long no more keep-alives are sent to it.
+	relayAffinityAttempts = 5
+	relayAffinityTTL      = time.Minute
+	// How long data keeps going direct after the path was last confirmed,
+	// even if the peer timed out meanwhile.
+	directAffinityTTL = 10 * time.Second
+)
+
+// Whether keep-alives to a are worth sending.
+func (p *peer) probeDirect(a address) bool {
+	until, ok := p.relayOnly[a]
+	if !ok {
+		return true
+	}
+	if p.config.Clock.Now().Before(until) {
+		return false
+	}
+	delete(p.relayOnly, a)
+	return true
+}
+
+// Called for every keep-alive sent to a.
+func (p *peer) probedDirect(a address) {
+	if _, ok := p.alivePeers[a]; ok {
+		delete(p.directFailures, a)
+		return
+	}
+	p.directFailures[a] += 1
+	if p.directFailures[a] >= relayAffinityAttempts {
+		p.logInfo("only relaying to", addrFromKey(a), "for", relayAffinityTTL)
+		p.relayOnly[a] = p.config.Clock.Now().Add(relayAffinityTTL)
+		delete(p.directFailures, a)
+	}
+}
+
+// Called when the direct path to a proved to work.
+func (p *peer) confirmDirect(a address) {
+	delete(p.directFailures, a)
+	delete(p.relayOnly, a)
+	p.confirmedDirect[a] = p.config.Clock.Now()
+}
+
+// Whether data to a goes direct.
+func (p *peer) direct(a address) bool {
+	if _, ok := p.alivePeers[a]; ok {
+		return true
+	}
+	t, ok := p.confirmedDirect[a]
+	return ok && p.config.Clock.Now().Sub(t) < directAffinityTTL
+}
+
+// How data reaches a peer, see PeerConfig.OnTransportChange.
+type Path int
+
+const (
+	PathRelayed Path = iota
+	PathDirect
+)
+
+func (p Path) String() string {
+	if p == PathDirect {
+		return "direct"
+	}
+	return "relayed"
+}
+
+// Reports a change of the route data to a takes since the last check.
+func (p *peer) checkRoute(a address) {
+	id, ok := p.peerIds[a]
+	if !ok {
+		return
+	}
+	direct := p.direct(a)
+	if _, was := p.directRoutes[a]; was == direct {
+		return
+	}
+	now := PathRelayed
+	if direct {
+		p.directRoutes[a] = struct{}{}
+		now = PathDirect
+	} else {
+		delete(p.directRoutes, a)
+	}
+	p.logInfo("data to", addrFromKey(a), "now goes", now)
+	if p.config.OnTransportChange != nil {
+		p.config.OnTransportChange(id, now)
+	}
+}
+
+// Whether relaying to a, which lost its direct path, has to wait for
+// MinRelayInterval. Otherwise counts a relay to a now.
+func (p *peer) relayThrottled(a address) bool {
+	interval := p.config.MinRelayInterval
+	if _, was := p.confirmedDirect[a]; !was || interval <= 0 {
+		return false
+	}
+	now := p.config.Clock.Now()
+	if last, ok := p.lastRelay[a]; ok && now.Sub(last) < interval {
+		return true
+	}
+	p.lastRelay[a] = now
+	return false
+}
@@ -0,0 +1,163 @@
+package mesher
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"log"
+	"net"
+	"time"
+)
+
+/******************************************************************************/
+/* AMPLIFICATION                                                              */
+/******************************************************************************/
+
+// Most unvalidated sources credited at a time. Once reached, the credit of
+// sources silent for PeerTimeout is forgotten, and if that is not enough,
+// new sources are only credited for the request at hand.
+const maxCredited = 4096
+
+// What an unvalidated source may still be sent, and when it last sent.
+type credit struct {
+	bytes int
+	last  time.Time
+	// In server.credited.
+	e *list.Element
+}
+
+// Whether another source may be credited, forgetting stale credit if
+// needed. Only the least recently credited sources are looked at.
+func (s *server) roomForCredit() bool {
+	if len(s.credit) < maxCredited {
+		return true
+	}
+	now := s.config.Clock.Now()
+	for e := s.credited.Front(); e != nil; e = s.credited.Front() {
+		a := e.Value.(address)
+		if now.Sub(s.credit[a].last) <= defaultPeerTimeout {
+			break
+		}
+		s.forgetCredit(a)
+	}
+	return len(s.credit) < maxCredited
+}
+
+func (s *server) forgetCredit(a address) {
+	if c, ok := s.credit[a]; ok {
+		s.credited.Remove(c.e)
+		delete(s.credit, a)
+	}
+}
+
+// The cookie the peer at a proves it receives at a with, by echoing it in
+// getPeerList. Never zero.
+func (s *server) cookie(a address) uint64 {
+	return cookie(s.secret, a)
+}
+
+func cookie(secret [16]byte, a address) uint64 {
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write(a[:])
+	return max(binary.BigEndian.Uint64(mac.Sum(nil)), 1)
+}
+
+// Marks a getPeerList that echoes the cookie of its sender, so that the
+// server goroutine need not compute it.
+func checkCookie(m serverRequest, from *net.UDPAddr,
+	secret [16]byte) serverRequest {
+	if g, ok := m.(getPeerList); ok && g.Cookie != 0 {
+		g.echoed = g.Cookie == cookie(secret, addrKey(from))
+		return g
+	}
+	return m
+}
+
+// Whether the source a may be sent more than AmplificationLimit times what
+// it sent, marking it so once it echoed its cookie.
+func (s *server) validate(a address, echoed bool) bool {
+	if s.config.AmplificationLimit <= 0 {
+		return true
+	}
+	if _, ok := s.validated[a]; ok {
+		return true
+	}
+	if !echoed {
+		return false
+	}
+	s.validated[a] = struct{}{}
+	s.forgetCredit(a)
+	return true
+}
+
+// Processes request from an unvalidated source, passing on responses to
+// it only while they stay within AmplificationLimit times what it sent.
+func (s *server) processLimited(request serverMessage) {
+	a := addrKey(request.from)
+	c, tracked := s.credit[a]
+	tracked = tracked || s.roomForCredit()
+	c.bytes += request.size * s.config.AmplificationLimit
+	c.last = s.config.Clock.Now()
+	replies := make(chan response, channelCapacity)
+	request.m.updateServer(s, request.from, replies)
+	close(replies)
+	for r := range replies {
+		if r.to == nil || addrKey(r.to) != a {
+			s.responses <- r
+			continue
+		}
+		if _, ok := s.validated[a]; ok {
+			s.responses <- r
+			continue
+		}
+		n := encodedSize(r.m)
+		if n > c.bytes {
+			s.logWarn("dropping", messageName(r.m), "to unvalidated",
+				request.from, "exceeding the amplification limit")
+			s.drops.rateLimited.Add(1)
+			r.written(ErrDropped)
+			continue
+		}
+		c.bytes -= n
+		s.responses <- r
+	}
+	if _, ok := s.validated[a]; !ok && tracked {
+		if c.e != nil {
+			s.credited.Remove(c.e)
+		}
+		c.e = s.credited.PushBack(a)
+		s.credit[a] = c
+	}
+}
+
+// Roughly the size of the datagram carrying m.
+func encodedSize(m interface{}) int {
+	var b bytes.Buffer
+	if gob.NewEncoder(&b).Encode(&m) != nil {
+		return maxDatagram
+	}
+	return b.Len()
+}
+
+// Answers getPeerList from an unvalidated source with just its cookie.
+func (s *server) challenge(from *net.UDPAddr, replies chan response) {
+	replies <- response{to: from, m: peerList{
+		Partial:  true,
+		Version:  ProtocolVersion,
+		Observed: addrKey(from),
+		Cookie:   s.cookie(addrKey(from)),
+	}}
+}
+
+func newSecret() [16]byte {
+	var secret [16]byte
+	_, err := rand.Read(secret[:])
+	if err != nil {
+		log.Fatal("secret:", err)
+	}
+	return secret
+}
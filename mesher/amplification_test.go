@@ -0,0 +1,94 @@
+package mesher
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"testing"
+)
+
+func limitedServer(clock Clock) *server {
+	return &server{
+		config: ServerConfig{AmplificationLimit: 3, Clock: clock},
+		// Never read, big enough for the challenges of one test.
+		responses: make(chan response, 3*maxCredited),
+		drops:     &dropCounters{},
+		validated: make(map[address]struct{}),
+		credit:    make(map[address]credit),
+		credited:  list.New(),
+	}
+}
+
+func getPeerListFrom(i int) serverMessage {
+	from := &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)),
+		Port: 1000}
+	m := getPeerList{Version: ProtocolVersion}
+	return serverMessage{from, m, encodedSize(m)}
+}
+
+func TestCreditBounded(t *testing.T) {
+	clock := newTestClock()
+	s := limitedServer(clock)
+	for i := 0; i < 2*maxCredited; i++ {
+		s.processLimited(getPeerListFrom(i))
+	}
+	if len(s.credit) != maxCredited {
+		t.Fatalf("credited %d sources, want %d", len(s.credit), maxCredited)
+	}
+	if len(s.responses) != 2*maxCredited {
+		t.Errorf("challenged %d sources, want %d", len(s.responses),
+			2*maxCredited)
+	}
+
+	clock.Advance(2 * defaultPeerTimeout)
+	late := getPeerListFrom(2 * maxCredited)
+	s.processLimited(late)
+	if len(s.credit) != 1 {
+		t.Errorf("credited %d sources after they went silent, want 1",
+			len(s.credit))
+	}
+	if _, ok := s.credit[addrKey(late.from)]; !ok {
+		t.Error("new source not credited once stale credit expired")
+	}
+}
+
+func TestCreditForgottenOnValidation(t *testing.T) {
+	s := limitedServer(newTestClock())
+	m := getPeerListFrom(1)
+	s.processLimited(m)
+	if len(s.credit) != 1 {
+		t.Fatalf("credited %d sources, want 1", len(s.credit))
+	}
+	a := addrKey(m.from)
+	if !s.validate(a, true) {
+		t.Fatal("cookie not accepted")
+	}
+	if len(s.credit) != 0 {
+		t.Error("credit kept for a validated source")
+	}
+}
+
+func TestDecodersOpenAndCheckCookies(t *testing.T) {
+	registerMessages()
+	sealing := newSealing(make([]byte, 32), nil, logger{})
+	secret := newSecret()
+	requests := make(chan request, 2)
+	decoded := serverDecoders(requests, 2, &dropCounters{},
+		framing{sealing: sealing}, secret, &sync.WaitGroup{})
+	good := getPeerList{Version: ProtocolVersion,
+		Cookie: cookie(secret, addrKey(testAddr(1)))}
+	requests <- request{testAddr(1), sealing.seal(encoded(good))}
+	requests <- request{testAddr(2), sealing.seal(encoded(good))}
+	close(requests)
+	for d := range decoded {
+		m, ok := d.m.(getPeerList)
+		if !ok {
+			t.Fatalf("decoded %s", messageName(d.m))
+		}
+		want := addrKey(d.from) == addrKey(testAddr(1))
+		if m.echoed != want {
+			t.Errorf("cookie from %v echoed %v, want %v", d.from, m.echoed,
+				want)
+		}
+	}
+}
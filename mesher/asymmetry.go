@@ -0,0 +1,73 @@
+package mesher
+
+import (
+	"time"
+)
+
+/******************************************************************************/
+/* ASYMMETRY                                                                  */
+/******************************************************************************/
+
+// Keep-alives from a peer, and answers to those to it, see
+// PeerConfig.OnAsymmetricPath.
+type pathDirections struct {
+	// Since when keep-alives arrive without gaps of PeerTimeout, and the
+	// last.
+	inboundSince time.Time
+	inbound      time.Time
+	// The last answer to a keep-alive to the peer.
+	answered time.Time
+	// Reported as asymmetric, until answered again.
+	reported bool
+}
+
+func (p *peer) directions(a address) *pathDirections {
+	d, ok := p.paths[a]
+	if !ok {
+		d = &pathDirections{}
+		p.paths[a] = d
+	}
+	return d
+}
+
+// Called when a keep-alive from a arrived.
+func (p *peer) heardFrom(a address) {
+	d := p.directions(a)
+	now := p.config.Clock.Now()
+	if now.Sub(d.inbound) > p.config.PeerTimeout {
+		d.inboundSince = now
+	}
+	d.inbound = now
+}
+
+// Called when a answered a keep-alive.
+func (p *peer) answeredBy(a address) {
+	d := p.directions(a)
+	d.answered = p.config.Clock.Now()
+	if d.reported {
+		p.logInfo("path to", addrFromKey(a), "works both ways again")
+		d.reported = false
+	}
+}
+
+// Reports peers whose keep-alives kept arriving for PeerTimeout while
+// none of those to them was answered: their packets reach the peer, but
+// the peer's do not reach them.
+func (p *peer) checkAsymmetry() {
+	now := p.config.Clock.Now()
+	timeout := p.config.PeerTimeout
+	for a, d := range p.paths {
+		id, ok := p.peerIds[a]
+		if !ok || d.reported || now.Sub(d.inbound) > timeout ||
+			now.Sub(d.inboundSince) < timeout ||
+			now.Sub(d.answered) < timeout {
+			continue
+		}
+		p.logWarn("path to", addrFromKey(a),
+			"is asymmetric, it reaches us but we do not reach it")
+		d.reported = true
+		if p.config.OnAsymmetricPath != nil {
+			p.config.OnAsymmetricPath(id)
+		}
+	}
+}
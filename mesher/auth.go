@@ -0,0 +1,75 @@
+package mesher
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"net"
+)
+
+/******************************************************************************/
+/* AUTHENTICATION                                                             */
+/******************************************************************************/
+
+// Every peer hands each other peer a random key with its keep-alives, with
+// which that peer authenticates the data it sends directly. Keys travel in
+// the clear, so this only keeps out spoofers unable to watch the path.
+
+const (
+	authKeySize = 32
+	authMACSize = 16
+)
+
+// The key a has to authenticate its direct data to the peer with.
+func (p *peer) receiveKey(a address) []byte {
+	key, ok := p.keys.auth[a]
+	if !ok {
+		key = make([]byte, authKeySize)
+		_, err := rand.Read(key)
+		if err != nil {
+			log.Fatal("auth key:", err)
+		}
+		p.keys.setAuth(a, key)
+	}
+	return key
+}
+
+func (m dataDirect) mac(key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(m.Data)
+	h.Write([]byte(m.Codec))
+	var b [26]byte
+	binary.BigEndian.PutUint64(b[0:], m.Seq)
+	binary.BigEndian.PutUint64(b[8:], uint64(m.Parity))
+	binary.BigEndian.PutUint64(b[16:], m.Origin)
+	binary.BigEndian.PutUint16(b[24:], m.Stream)
+	h.Write(b[:])
+	return h.Sum(nil)[:authMACSize]
+}
+
+// Authenticates m for a, if a handed out a key.
+func (p *peer) sign(a address, m dataDirect) dataDirect {
+	if key, ok := p.sendKeys[a]; ok {
+		m.MAC = m.mac(key)
+	}
+	return m
+}
+
+// Whether m from from passes authentication, if required.
+func (p *peer) verify(from *net.UDPAddr, m dataDirect) bool {
+	if !p.config.AuthDirect || m.pre.verified {
+		return true
+	}
+	key := p.receiveKey(addrKey(from))
+	if hmac.Equal(m.MAC, m.mac(key)) {
+		return true
+	}
+	p.logWarn("dropping dataDirect failing authentication from", from)
+	p.drops.authFailed.Add(1)
+	if p.config.OnAuthFailure != nil {
+		p.config.OnAuthFailure(unmapped(from))
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package mesher
+
+import (
+	"sync"
+	"time"
+)
+
+/******************************************************************************/
+/* BANDWIDTH                                                                  */
+/******************************************************************************/
+
+// Paces the datagrams the writers of a node send to limit bytes per
+// second, see PeerConfig.MaxOutboundBps, and measures the rate sent.
+type bandwidth struct {
+	limit int
+	clock Clock
+	mutex sync.Mutex
+	// Budget left, negative while sending ahead of it.
+	tokens float64
+	filled time.Time
+	// Bytes sent in the second since start, and in the second before.
+	start time.Time
+	bytes uint64
+	last  uint64
+}
+
+func (b *bandwidth) init(limit int, clock Clock) {
+	b.limit = limit
+	b.clock = clock
+	b.filled = clock.Now()
+	b.start = clock.Now()
+}
+
+// Accounts for a datagram of n bytes. Over budget, waits until the budget
+// allows it, which backs up the send queues. Those drop the datagrams of
+// lowest priority first.
+func (b *bandwidth) send(n int) {
+	if b.clock == nil {
+		return
+	}
+	b.mutex.Lock()
+	now := b.clock.Now()
+	b.measure(now)
+	b.bytes += uint64(n)
+	var wait time.Duration
+	if b.limit > 0 {
+		budget := float64(b.limit)
+		b.tokens += now.Sub(b.filled).Seconds() * budget
+		b.tokens = min(b.tokens, budget) - float64(n)
+		b.filled = now
+		if b.tokens < 0 {
+			wait = time.Duration(-b.tokens / budget * float64(time.Second))
+		}
+	}
+	b.mutex.Unlock()
+	if wait > 0 {
+		<-b.clock.After(wait)
+	}
+}
+
+// Starts a new second of measurement, if due.
+func (b *bandwidth) measure(now time.Time) {
+	elapsed := now.Sub(b.start)
+	if elapsed < time.Second {
+		return
+	}
+	if elapsed < 2*time.Second {
+		b.last = b.bytes
+	} else {
+		b.last = 0
+	}
+	b.bytes = 0
+	b.start = now
+}
+
+// Bytes sent in the last full second, see Stats.OutboundRate.
+func (b *bandwidth) rate() uint64 {
+	if b.clock == nil {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.measure(b.clock.Now())
+	return b.last
+}
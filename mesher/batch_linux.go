@@ -0,0 +1,144 @@
+//go:build linux
+
+package mesher
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+type batchReaderConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// Reads up to batch datagrams per recvmmsg call until conn fails. Returns
+// false without reading, if conn is not a plain UDP socket.
+func readBatches(conn Transport, batch int,
+	deliver func([]byte, *net.UDPAddr)) bool {
+	c, ok := conn.(*net.UDPConn)
+	if !ok {
+		return false
+	}
+	var pc batchReaderConn
+	if c.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		pc = ipv4.NewPacketConn(c)
+	} else {
+		pc = ipv6.NewPacketConn(c)
+	}
+	msgs := make([]ipv4.Message, batch)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, maxMessageSize)}
+	}
+	for {
+		n, err := pc.ReadBatch(msgs, 0)
+		if err != nil {
+			return true
+		}
+		for i := range msgs[:n] {
+			from, ok := msgs[i].Addr.(*net.UDPAddr)
+			if ok {
+				deliver(msgs[i].Buffers[0][:msgs[i].N], from)
+			}
+			msgs[i].Buffers[0] = make([]byte, maxMessageSize)
+		}
+	}
+}
+
+type batchWriterConn interface {
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// Writes queued responses with sendmmsg until out is closed. Returns false
+// without writing, if conn is not a plain UDP socket.
+func writeBatches(conn Transport, batch int, window time.Duration,
+	clock Clock, out chan response, encode func(response) ([]byte, bool),
+	wrote func(response, error), l logger) bool {
+	c, ok := conn.(*net.UDPConn)
+	if !ok {
+		return false
+	}
+	var pc batchWriterConn
+	v6 := c.LocalAddr().(*net.UDPAddr).IP.To4() == nil
+	if v6 {
+		pc = ipv6.NewPacketConn(c)
+	} else {
+		pc = ipv4.NewPacketConn(c)
+	}
+	msgs := make([]ipv4.Message, 0, batch)
+	batched := make([]response, 0, batch)
+	add := func(m response) {
+		b, ok := encode(m)
+		if !ok {
+			return
+		}
+		to := m.to
+		if v6 {
+			// Dual-stack sockets address IPv4 peers as IPv4-mapped.
+			to = &net.UDPAddr{IP: to.IP.To16(), Port: to.Port, Zone: to.Zone}
+		}
+		msgs = append(msgs, ipv4.Message{Buffers: [][]byte{b}, Addr: to})
+		batched = append(batched, m)
+	}
+	flush := func() {
+		pending := msgs
+		written := 0
+		var err error
+		for len(pending) > 0 {
+			var n int
+			n, err = pc.WriteBatch(pending, 0)
+			if err != nil {
+				l.logError("batch write:", err)
+				break
+			}
+			pending = pending[n:]
+			written += n
+		}
+		for i, m := range batched {
+			if i < written {
+				wrote(m, nil)
+			} else {
+				wrote(m, err)
+			}
+		}
+		msgs = msgs[:0]
+		batched = batched[:0]
+	}
+	for {
+		m, ok := <-out
+		if !ok {
+			return true
+		}
+		add(m)
+		var expired <-chan time.Time
+		if window > 0 {
+			expired = clock.After(window)
+		}
+	collect:
+		for len(msgs) < batch {
+			var m response
+			var ok bool
+			if window > 0 {
+				select {
+				case m, ok = <-out:
+				case <-expired:
+					break collect
+				}
+			} else {
+				select {
+				case m, ok = <-out:
+				default:
+					break collect
+				}
+			}
+			if !ok {
+				flush()
+				return true
+			}
+			add(m)
+		}
+		flush()
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package mesher
+
+import (
+	"net"
+	"time"
+)
+
+// Batched reads need recvmmsg, which only Linux offers.
+func readBatches(conn Transport, batch int,
+	deliver func([]byte, *net.UDPAddr)) bool {
+	return false
+}
+
+// Batched writes need sendmmsg, which only Linux offers.
+func writeBatches(conn Transport, batch int, window time.Duration,
+	clock Clock, out chan response, encode func(response) ([]byte, bool),
+	wrote func(response, error), l logger) bool {
+	return false
+}
@@ -0,0 +1,50 @@
+package mesher
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Reads datagrams flooded over loopback, one or batch per system call.
+func BenchmarkReader(b *testing.B) {
+	for _, batch := range []int{1, 64} {
+		b.Run("batch="+strconv.Itoa(batch), func(b *testing.B) {
+			conn, err := net.ListenUDP("udp4",
+				&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				b.Skip("no loopback:", err)
+			}
+			sender, err := net.DialUDP("udp4", nil,
+				conn.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				b.Skip("no loopback:", err)
+			}
+			requests := reader(conn, batch, framing{}, &sync.WaitGroup{})
+			stop := make(chan struct{})
+			go func() {
+				buf := make([]byte, 200)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						sender.Write(buf)
+					}
+				}
+			}()
+			b.SetBytes(200)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				<-requests
+			}
+			b.StopTimer()
+			close(stop)
+			conn.Close()
+			sender.Close()
+			for range requests {
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package mesher
+
+/******************************************************************************/
+/* BOOTSTRAP                                                                  */
+/******************************************************************************/
+
+// Leaves the server once enough peers are alive, or polling took too long
+// with some alive, and contacts it again once too few are left. See
+// PeerConfig.BootstrapPeers.
+func (p *peer) checkBootstrap() {
+	c := p.config
+	if (c.BootstrapPeers <= 0 && c.BootstrapTimeout <= 0) || p.group != nil {
+		return
+	}
+	now := c.Clock.Now()
+	alive := len(p.alivePeers)
+	if p.detached {
+		if alive < max(c.RebootstrapBelow, 1) {
+			p.logInfo("only", alive, "peers alive, contacting the server again")
+			p.detached = false
+			p.bootstrapSince = now
+			p.serverSince = now
+		}
+		return
+	}
+	enough := c.BootstrapPeers > 0 && alive >= c.BootstrapPeers
+	// Not leaving with too few peers to stay away.
+	late := c.BootstrapTimeout > 0 &&
+		now.Sub(p.bootstrapSince) >= c.BootstrapTimeout &&
+		alive >= max(c.RebootstrapBelow, 1)
+	if enough || late {
+		p.logInfo("bootstrapped with", alive, "peers alive, leaving the server")
+		p.detached = true
+	}
+}
@@ -0,0 +1,26 @@
+package mesher
+
+import "testing"
+
+// A peer left without peers must not stay away from the server for good,
+// even with RebootstrapBelow unset.
+func TestRebootstrapsWithNoPeersAlive(t *testing.T) {
+	p := testPeer(PeerConfig{BootstrapPeers: 2})
+	p.alivePeers[addrKey(testAddr(2))] = struct{}{}
+	p.alivePeers[addrKey(testAddr(3))] = struct{}{}
+	p.checkBootstrap()
+	if !p.detached {
+		t.Fatalf("stayed with the server with enough peers alive")
+	}
+
+	delete(p.alivePeers, addrKey(testAddr(2)))
+	p.checkBootstrap()
+	if !p.detached {
+		t.Errorf("contacted the server again with a peer alive")
+	}
+	delete(p.alivePeers, addrKey(testAddr(3)))
+	p.checkBootstrap()
+	if p.detached {
+		t.Errorf("stayed away from the server with no peers alive")
+	}
+}
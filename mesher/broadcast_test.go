@@ -0,0 +1,85 @@
+package mesher
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBroadcastNoPeers(t *testing.T) {
+	called := 0
+	p := testPeer(PeerConfig{OnBroadcastNoPeers: func() { called += 1 }})
+	err := p.broadcast(outgoing{buf: []byte("data")}, p.responses)
+	if !errors.Is(err, ErrDropped) || called != 1 {
+		t.Errorf("broadcast without peers returned %v, called back %d times",
+			err, called)
+	}
+	if sent := p.testSent(); len(sent) != 0 {
+		t.Errorf("broadcast without peers sent %d datagrams", len(sent))
+	}
+
+	p.testLearn(testAddr(2))
+	err = p.broadcast(outgoing{buf: []byte("data")}, p.responses)
+	if err != nil || called != 1 {
+		t.Errorf("broadcast to a peer returned %v, called back %d times",
+			err, called)
+	}
+	if sent := p.testSent(); len(sent) != 1 {
+		t.Errorf("broadcast to a peer sent %d datagrams, want 1", len(sent))
+	}
+}
+
+func TestNeverSendsToItself(t *testing.T) {
+	p := testPeer(PeerConfig{})
+	own, other := addrKey(testAddr(1)), addrKey(testAddr(2))
+	m := peerList{Addresses: []address{own, other}, Version: ProtocolVersion}
+	m.updatePeer(p, testAddr(0), p.responses, p.data)
+	if _, ok := p.peerIds[own]; ok {
+		t.Error("own address in the peer list became a peer")
+	}
+	p.keepAlive(p.responses)
+	p.broadcast(outgoing{buf: []byte("data")}, p.responses)
+	toOther := 0
+	for _, r := range p.testSent() {
+		switch addrKey(r.to) {
+		case own:
+			t.Errorf("sent %s to itself", messageName(r.m))
+		case other:
+			toOther += 1
+		}
+	}
+	if toOther == 0 {
+		t.Error("sent nothing to the other peer")
+	}
+}
+
+// Hands over direct and relayed data of origin from the peer at testAddr(2)
+// and returns how many arrived.
+func echoed(p *peer, origin uint64) int {
+	other := addrKey(testAddr(2))
+	dataDirect{Data: []byte("direct"), Seq: 1, Origin: origin}.updatePeer(
+		p, testAddr(2), p.responses, p.data)
+	dataRelayedFrom{From: other, Data: []byte("relayed"), Seq: 2,
+		Origin: origin}.updatePeer(p, testAddr(0), p.responses, p.data)
+	n := len(p.data)
+	for len(p.data) > 0 {
+		<-p.data
+	}
+	return n
+}
+
+func TestOwnEchoesDropped(t *testing.T) {
+	p := testPeer(PeerConfig{})
+	p.testLearn(testAddr(2))
+	if n := echoed(p, p.origin); n != 0 {
+		t.Errorf("handed over %d own echoes", n)
+	}
+	if n := echoed(p, p.origin+1); n != 2 {
+		t.Errorf("handed over %d of 2 datagrams of another origin", n)
+	}
+
+	p = testPeer(PeerConfig{DeliverEchoes: true})
+	p.testLearn(testAddr(2))
+	if n := echoed(p, p.origin); n != 2 {
+		t.Errorf("handed over %d of 2 own echoes with DeliverEchoes", n)
+	}
+}
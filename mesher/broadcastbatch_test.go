@@ -0,0 +1,67 @@
+package mesher_test
+
+import (
+	"mesher/mesher"
+	"mesher/mesher/meshertest"
+	"testing"
+	"time"
+)
+
+// Broadcasts 64 payloads to a connected peer, one call each or in one
+// BroadcastBatch.
+func BenchmarkBroadcastBatch(b *testing.B) {
+	network := meshertest.NewNetwork()
+	clock := meshertest.NewClock()
+	serverConn := network.Listen()
+	server := mesher.ServerWithConfig(mesher.ServerConfig{
+		Transport: serverConn,
+		Clock:     clock,
+	})
+	var peers []*mesher.PeerHandle
+	var conns []*meshertest.Conn
+	for i := 0; i < 2; i++ {
+		conn := network.Listen()
+		h := mesher.PeerWithConfig(mesher.PeerConfig{
+			ServerAddress: serverConn.LocalAddr().String(),
+			Transport:     conn,
+			Clock:         clock,
+		})
+		_, _, incoming := h.Channels()
+		go func() {
+			for range incoming {
+			}
+		}()
+		peers = append(peers, h)
+		conns = append(conns, conn)
+	}
+	for i := 0; i < 20 && peers[0].MeshSize() < 2; i++ {
+		clock.Advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if peers[0].MeshSize() < 2 {
+		b.Fatal("peers did not connect")
+	}
+
+	batch := make([][]byte, 64)
+	for i := range batch {
+		batch[i] = make([]byte, 100)
+	}
+	b.Run("single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, data := range batch {
+				peers[0].Broadcast(data)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			peers[0].BroadcastBatch(batch)
+		}
+	})
+
+	for _, c := range conns {
+		c.Close()
+	}
+	serverConn.Close()
+	awaitDone(b, clock, peers[0].Done(), peers[1].Done(), server.Done())
+}
@@ -0,0 +1,41 @@
+package mesher
+
+import "fmt"
+
+/******************************************************************************/
+/* CAPABILITIES                                                               */
+/******************************************************************************/
+
+// Features a peer understands, exchanged on first contact via the server's
+// peer list and with every keep-alive. Data to a peer only uses a feature
+// both sides understand, so features can roll out one node at a time.
+type capabilities uint64
+
+const (
+	capCompression capabilities = 1 << iota
+	capEncryption
+	capAcks
+	capFEC
+	capOpaque
+	capPadding
+)
+
+// Everything this build understands.
+const supportedCapabilities = capCompression | capEncryption | capAcks |
+	capFEC | capOpaque | capPadding
+
+// Agrees with a on the features both understand, given those it advertised.
+// Zero for peers predating capabilities.
+func (p *peer) learnCapabilities(a address, c capabilities) {
+	agreed := c & supportedCapabilities
+	if old, ok := p.caps[a]; ok && old == agreed {
+		return
+	}
+	p.logDebug(fmt.Sprintf("agreed on capabilities %#x with", uint64(agreed)),
+		addrFromKey(a))
+	p.caps[a] = agreed
+}
+
+func (p *peer) supports(a address, c capabilities) bool {
+	return p.caps[a]&c == c
+}
@@ -0,0 +1,92 @@
+package mesher
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"slices"
+)
+
+/******************************************************************************/
+/* CODECS                                                                     */
+/******************************************************************************/
+
+// Compression codecs peers may negotiate, see PeerConfig.Codecs.
+const (
+	CodecFlate = "flate"
+	CodecZlib  = "zlib"
+)
+
+func knownCodec(codec string) bool {
+	return codec == CodecFlate || codec == CodecZlib
+}
+
+// The first of ours the remote side supports as well, "" for none.
+func negotiateCodec(ours, theirs []string) string {
+	for _, c := range ours {
+		if knownCodec(c) && slices.Contains(theirs, c) {
+			return c
+		}
+	}
+	return ""
+}
+
+func compress(codec string, data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	var w io.WriteCloser
+	switch codec {
+	case CodecFlate:
+		fw, err := flate.NewWriter(&b, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		w = fw
+	case CodecZlib:
+		zw, err := zlib.NewWriterLevel(&b, zlib.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Decompresses at most maxMessageSize bytes, so a small datagram cannot
+// expand into an arbitrarily large allocation.
+func decompress(codec string, data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	switch codec {
+	case CodecFlate:
+		r = flate.NewReader(bytes.NewReader(data))
+	case CodecZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxMessageSize {
+		return nil, fmt.Errorf("decompressed data exceeds %d bytes",
+			maxMessageSize)
+	}
+	return out, nil
+}
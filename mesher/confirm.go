@@ -0,0 +1,35 @@
+package mesher
+
+import "time"
+
+/******************************************************************************/
+/* ALIVE CONFIRMATION                                                         */
+/******************************************************************************/
+
+// Answers to keep-alives from a peer not yet alive, see
+// PeerConfig.AliveConfirmations.
+type aliveStreak struct {
+	count int
+	last  time.Time
+}
+
+// Whether a answering a keep-alive makes it alive. Answers count towards
+// the promotion only while each comes within PeerTimeout of the last.
+func (p *peer) confirmAlive(a address) bool {
+	if _, ok := p.alivePeers[a]; ok || p.config.AliveConfirmations <= 1 {
+		return true
+	}
+	now := p.config.Clock.Now()
+	s := p.pendingAlive[a]
+	if s == nil || now.Sub(s.last) > p.config.PeerTimeout {
+		s = &aliveStreak{}
+		p.pendingAlive[a] = s
+	}
+	s.count += 1
+	s.last = now
+	if s.count < p.config.AliveConfirmations {
+		return false
+	}
+	delete(p.pendingAlive, a)
+	return true
+}
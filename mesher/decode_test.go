@@ -0,0 +1,41 @@
+package mesher
+
+import (
+	"bytes"
+	"encoding/gob"
+	"runtime"
+	"testing"
+)
+
+func encoded(m interface{}) []byte {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(&m); err != nil {
+		panic(err)
+	}
+	return b.Bytes()
+}
+
+// Crafted datagrams must neither panic the decoders nor make them allocate
+// far beyond the datagram's size.
+func FuzzDecode(f *testing.F) {
+	registerMessages()
+	f.Add(encoded(getPeerList{}))
+	f.Add(encoded(peerList{Addresses: []address{{1}, {2}}}))
+	f.Add(encoded(keepAlive{}))
+	f.Add(encoded(dataDirect{Data: []byte("data")}))
+	f.Add(encoded(dataRelayTo{To: address{1}, Data: []byte("data")}))
+	f.Add(dataOpaque{dataDirect{Data: []byte("data"), Seq: 1}}.frame())
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		var s serverRequest
+		decode(buf, &s)
+		decodePeerRequest(buf)
+		runtime.ReadMemStats(&after)
+		allocated := after.TotalAlloc - before.TotalAlloc
+		if limit := uint64(1<<20 + 64*len(buf)); allocated > limit {
+			t.Errorf("decoding %d bytes allocated %d bytes", len(buf),
+				allocated)
+		}
+	})
+}
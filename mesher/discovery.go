@@ -0,0 +1,125 @@
+package mesher
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/******************************************************************************/
+/* DISCOVERY                                                                  */
+/******************************************************************************/
+
+const defaultDiscoveryPort = "8982"
+
+// Peers not announcing themselves for this long are forgotten.
+const discoveryTimeout = 10 * time.Second
+
+// Sent to the multicast group on every tick in place of getPeerList.
+type announce struct {
+	Name  string
+	Group string
+}
+
+func (m announce) updatePeer(p *peer, from *net.UDPAddr,
+	replies chan response, data chan PeerMsg) {
+	p.discovered(addrKey(from), m.Name, m.Group)
+}
+
+func (p *peer) discovered(a address, name, group string) {
+	if _, ok := p.self[a]; ok {
+		return
+	}
+	p.announced[a] = p.config.Clock.Now()
+	p.names[a] = name
+	p.groups[a] = group
+	if _, ok := p.peerIds[a]; !ok {
+		p.logInfo("discovered", addrFromKey(a))
+		p.peerIds[a] = p.nextPeerId
+		p.nextPeerId += 1
+		p.joined(a)
+	}
+}
+
+func (p *peer) expireAnnounced() {
+	now := p.config.Clock.Now()
+	for a, t := range p.announced {
+		if now.Sub(t) > discoveryTimeout {
+			p.logInfo("announcements ceased", addrFromKey(a))
+			delete(p.announced, a)
+			p.forgetPeer(a)
+		}
+	}
+}
+
+// Joins the multicast group and hands the peers announcing themselves to
+// the peer goroutine, until it stopped. Counts its reader and decoder in
+// running until they exited.
+func listenAnnouncements(network string, group *net.UDPAddr, f framing,
+	commands chan func(*peer), stopped chan struct{},
+	running *sync.WaitGroup) {
+	conn, err := net.ListenMulticastUDP(network, nil, group)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		defer live()()
+		<-stopped
+		conn.Close()
+	}()
+	requests := reader(conn, 1, f, running)
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		defer live()()
+		for request := range requests {
+			buf, ok := f.sealing.unseal(request.buffer, request.from)
+			if !ok {
+				continue
+			}
+			var m peerRequest
+			err := decode(buf, &m)
+			if err != nil {
+				f.logDebug("ignoring", err, request)
+				continue
+			}
+			a, ok := m.(announce)
+			if !ok {
+				f.logDebug("ignoring", messageName(m), "on multicast group")
+				continue
+			}
+			from := request.from
+			select {
+			case commands <- func(p *peer) { a.updatePeer(p, from, nil, nil) }:
+			case <-stopped:
+			}
+		}
+		f.logDebug("listenAnnouncements shutting down")
+	}()
+}
+
+// Limits how far announcements travel, one hop if ttl is zero.
+func setMulticastTTL(conn Transport, group *net.UDPAddr, ttl int,
+	l logger) {
+	if ttl <= 0 {
+		return
+	}
+	c, ok := conn.(*net.UDPConn)
+	if !ok {
+		l.logWarn("MulticastTTL needs a socket of its own, ignoring it")
+		return
+	}
+	var err error
+	if group.IP.To4() != nil {
+		err = ipv4.NewPacketConn(c).SetMulticastTTL(ttl)
+	} else {
+		err = ipv6.NewPacketConn(c).SetMulticastHopLimit(ttl)
+	}
+	if err != nil {
+		l.logWarn("cannot set multicast TTL:", err)
+	}
+}
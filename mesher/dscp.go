@@ -0,0 +1,49 @@
+package mesher
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/******************************************************************************/
+/* DSCP                                                                       */
+/******************************************************************************/
+
+// Marks all datagrams of the socket with dscp, see PeerConfig.DSCP. Zero
+// leaves the marking alone. Failures only log, as not every platform lets
+// applications set it.
+func setDSCP(conn Transport, dscp int, l logger) {
+	if dscp == 0 {
+		return
+	}
+	if dscp < 0 || dscp > 63 {
+		l.logWarn("ignoring DSCP", dscp, "outside 0 to 63")
+		return
+	}
+	c, ok := conn.(*net.UDPConn)
+	if !ok {
+		l.logWarn("DSCP needs a socket of its own, ignoring it")
+		return
+	}
+	// The DSCP fills the upper six bits of the TOS or traffic class.
+	tos := dscp << 2
+	ip := c.LocalAddr().(*net.UDPAddr).IP
+	if ip.To4() != nil {
+		err := ipv4.NewConn(c).SetTOS(tos)
+		if err != nil {
+			l.logWarn("cannot set DSCP:", err)
+		}
+		return
+	}
+	err := ipv6.NewConn(c).SetTrafficClass(tos)
+	if err != nil {
+		l.logWarn("cannot set DSCP:", err)
+	}
+	if ip.IsUnspecified() {
+		// Dual-stack sockets mark IPv4 datagrams by TOS. Single-stack IPv6
+		// sockets reject it, which is fine.
+		ipv4.NewConn(c).SetTOS(tos)
+	}
+}
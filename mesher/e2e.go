@@ -0,0 +1,138 @@
+package mesher
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"log"
+	"strings"
+)
+
+/******************************************************************************/
+/* END-TO-END                                                                 */
+/******************************************************************************/
+
+// Appended to the codec of data sealed with the key of the pair, see
+// PeerConfig.EndToEnd. Sealing comes last, after compression and padding.
+const e2eSuffix = "+e2e"
+
+// Nil if not enabled.
+func newKeyPair(enabled bool) *ecdh.PrivateKey {
+	if !enabled {
+		return nil
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal("key pair:", err)
+	}
+	return key
+}
+
+// Public key to hand out with keep-alives and to the server, nil without
+// EndToEnd.
+func (p *peer) publicKey() []byte {
+	if p.ecdh == nil {
+		return nil
+	}
+	return p.ecdh.PublicKey().Bytes()
+}
+
+// Derives the key shared with a from its public key pub. The first key
+// of a is pinned: a changed one may come from anyone spoofing a's address,
+// so it is ignored until a is forgotten.
+func (p *peer) learnPublic(a address, pub []byte) {
+	if p.ecdh == nil || len(pub) == 0 || bytes.Equal(p.publics[a], pub) ||
+		!p.supports(a, capEncryption) {
+		return
+	}
+	if _, pinned := p.publics[a]; pinned {
+		p.logWarn("ignoring changed public key of", addrFromKey(a))
+		return
+	}
+	remote, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		p.logWarn("ignoring public key of", addrFromKey(a), err)
+		return
+	}
+	shared, err := p.ecdh.ECDH(remote)
+	if err != nil {
+		p.logWarn("ignoring public key of", addrFromKey(a), err)
+		return
+	}
+	// Both sides hash the same: the secret, then the keys in order.
+	own := p.publicKey()
+	first, second := own, pub
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(first)
+	h.Write(second)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		log.Fatal("peer key: ", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Fatal("peer key: ", err)
+	}
+	p.logInfo("established key with", addrFromKey(a))
+	p.publics[a] = pub
+	p.keys.setShared(a, aead)
+}
+
+// Seals buf encoded with codec for a. False if there is no key for a yet,
+// in which case the data must not go out.
+func (p *peer) seal(a address, buf []byte, codec string) ([]byte, string,
+	bool) {
+	if p.ecdh == nil {
+		return buf, codec, true
+	}
+	aead, ok := p.keys.shared[a]
+	if !ok {
+		p.logDebug("no key for", addrFromKey(a), "yet, dropping data")
+		return nil, codec, false
+	}
+	nonce := make([]byte, aead.NonceSize(),
+		aead.NonceSize()+len(buf)+aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		log.Fatal("nonce:", err)
+	}
+	return aead.Seal(nonce, nonce, buf, nil), codec + e2eSuffix, true
+}
+
+// Opens and decodes data from a, unless a decoder did. With EndToEnd, data
+// that is not sealed is rejected.
+func (p *peer) openData(a address, buf []byte, codec string,
+	pre prepared) ([]byte, bool) {
+	if pre.opened {
+		return pre.plain, true
+	}
+	if !strings.HasSuffix(codec, e2eSuffix) {
+		if p.ecdh != nil {
+			p.logWarn("dropping unsealed data from", addrFromKey(a))
+			p.drops.authFailed.Add(1)
+			return nil, false
+		}
+		return p.decodeData(buf, codec)
+	}
+	aead, ok := p.keys.shared[a]
+	if !ok || len(buf) < aead.NonceSize() {
+		p.logWarn("cannot open data from", addrFromKey(a))
+		p.drops.authFailed.Add(1)
+		return nil, false
+	}
+	nonce := buf[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, buf[aead.NonceSize():], nil)
+	if err != nil {
+		p.logWarn("cannot open data from", addrFromKey(a), err)
+		p.drops.authFailed.Add(1)
+		return nil, false
+	}
+	return p.decodeData(plain, strings.TrimSuffix(codec, e2eSuffix))
+}
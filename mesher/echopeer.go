@@ -0,0 +1,16 @@
+package mesher
+
+/******************************************************************************/
+/* ECHO PEER                                                                  */
+/******************************************************************************/
+
+// Sends data about to be handed over back to its sender on the same stream,
+// see PeerConfig.EchoPeer. Copies m.Buf before the application owns it.
+func (p *peer) echoBack(m PeerMsg) {
+	for a, id := range p.peerIds {
+		if id == m.PeerId {
+			p.sendTo(a, outgoing{buf: m.Buf, stream: m.Stream}, p.responses)
+			return
+		}
+	}
+}
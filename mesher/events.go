@@ -0,0 +1,50 @@
+package mesher
+
+import (
+	"net/netip"
+)
+
+/******************************************************************************/
+/* EVENTS                                                                     */
+/******************************************************************************/
+
+// What happened to a peer, see PeerEvent.
+type PeerEventKind int
+
+const (
+	// Listed or discovered, as passed to OnPeerJoined.
+	PeerJoined PeerEventKind = iota
+	// Forgotten, as passed to OnPeerLeft.
+	PeerLeft
+)
+
+// A change of the known peers, see PeerHandle.Events.
+type PeerEvent struct {
+	Kind    PeerEventKind
+	PeerId  uint64
+	Address netip.AddrPort
+	// Advertised by the peer, if already known, see PeerConfig.Name.
+	Name string
+}
+
+// Queues e for Events, dropping it if the application does not keep up.
+func (p *peer) event(kind PeerEventKind, a address) {
+	if !p.eventsWanted {
+		return
+	}
+	e := PeerEvent{kind, p.peerIds[a], unmapped(addrFromKey(a)), p.names[a]}
+	select {
+	case p.events <- e:
+	default:
+		p.logWarn("events not received, dropping event of", e.PeerId)
+	}
+}
+
+// The peers joining and leaving, in order, like OnPeerJoined and
+// OnPeerLeft but without running on the peer goroutine. Events are only
+// queued from the first call on, and dropped while the channel is full.
+// Closed once the peer stopped.
+func (h *PeerHandle) Events() <-chan PeerEvent {
+	h.do(func(p *peer) { p.eventsWanted = true })
+	return h.events
+}
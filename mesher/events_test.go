@@ -0,0 +1,56 @@
+package mesher
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestEventsOnlyOnceWanted(t *testing.T) {
+	p := testPeer(PeerConfig{})
+	for i := 2; i < 5; i++ {
+		p.testLearn(testAddr(i))
+		p.joined(addrKey(testAddr(i)))
+	}
+	if len(p.events) != 0 {
+		t.Errorf("queued %d events nobody asked for", len(p.events))
+	}
+
+	p.eventsWanted = true
+	a := addrKey(testAddr(2))
+	p.joined(a)
+	e := <-p.events
+	if e.Kind != PeerJoined || e.PeerId != p.peerIds[a] {
+		t.Errorf("got %+v, want peer %d joined", e, p.peerIds[a])
+	}
+}
+
+// Names listed by the server arrive with the join events.
+func TestJoinEventsCarryNames(t *testing.T) {
+	s := testServer(ServerConfig{})
+	replies := make(chan response, 16)
+	for i, name := range []string{"alice", ""} {
+		m := getPeerList{Version: ProtocolVersion, Name: name}
+		m.updateServer(s, testAddr(2+i), replies)
+	}
+	var list peerList
+	for len(replies) > 0 {
+		r := <-replies
+		if addrKey(r.to) == addrKey(testAddr(3)) {
+			list = r.m.(peerList)
+		}
+	}
+
+	var joined []string
+	p := testPeer(PeerConfig{OnPeerJoined: func(_ uint64, _ netip.AddrPort,
+		name string) {
+		joined = append(joined, name)
+	}})
+	p.eventsWanted = true
+	list.updatePeer(p, testAddr(0), p.responses, p.data)
+	if e := <-p.events; e.Name != "alice" {
+		t.Errorf("join event named %q, want alice", e.Name)
+	}
+	if len(joined) != 1 || joined[0] != "alice" {
+		t.Errorf("OnPeerJoined called with %q, want alice", joined)
+	}
+}
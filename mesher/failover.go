@@ -0,0 +1,43 @@
+package mesher
+
+import (
+	"time"
+)
+
+/******************************************************************************/
+/* FAILOVER                                                                   */
+/******************************************************************************/
+
+// Moves on to the next of the servers once the current one timed out, so
+// relaying resumes via the next server to answer. Relay tokens of the old
+// server mean nothing to the new one.
+func (p *peer) failOver(responses chan response) {
+	if len(p.servers) < 2 {
+		return
+	}
+	next := p.servers[0]
+	for i, s := range p.servers {
+		if addrKey(s) == addrKey(p.server) {
+			next = p.servers[(i+1)%len(p.servers)]
+			break
+		}
+	}
+	p.logWarn("failing over from server", p.server, "to", next)
+	p.server = next
+	p.serverSince = p.config.Clock.Now()
+	clear(p.relayTokens)
+	p.cookie = 0
+	p.register(responses)
+}
+
+// Fails over as well when the current server never answered, which the
+// watcher cannot time out.
+func (p *peer) checkServer(responses chan response) {
+	if p.detached || p.serverAlive || p.serverSince == (time.Time{}) {
+		return
+	}
+	if p.config.Clock.Now().Sub(p.serverSince) > p.config.PeerTimeout {
+		p.reresolve()
+		p.failOver(responses)
+	}
+}
@@ -0,0 +1,139 @@
+package mesher
+
+import (
+	"encoding/binary"
+)
+
+/******************************************************************************/
+/* FEC                                                                        */
+/******************************************************************************/
+
+// Cap on PeerConfig.FECGroup, and how far back received data is kept to
+// recover from parity.
+const (
+	fecMaxGroup = 64
+	fecWindow   = 64
+)
+
+// Parity of the datagrams sent to one peer since the last parity datagram.
+type fecParity struct {
+	count int
+	acc   []byte
+}
+
+// Recent data received from one peer that sends parity.
+type fecReceived struct {
+	got     map[uint64]PeerMsg
+	highest uint64
+}
+
+const fecHeaderSize = 4
+
+// XORs the length of buf, its stream and buf into acc, growing acc as
+// needed.
+func xorFrame(acc []byte, stream uint16, buf []byte) []byte {
+	if need := fecHeaderSize + len(buf); len(acc) < need {
+		acc = append(acc, make([]byte, need-len(acc))...)
+	}
+	acc[0] ^= byte(len(buf) >> 8)
+	acc[1] ^= byte(len(buf))
+	acc[2] ^= byte(stream >> 8)
+	acc[3] ^= byte(stream)
+	for i, b := range buf {
+		acc[fecHeaderSize+i] ^= b
+	}
+	return acc
+}
+
+// Adds buf to the parity for a. Returns the parity once FECGroup datagrams
+// are covered, nil otherwise.
+func (p *peer) addParity(a address, stream uint16, buf []byte) []byte {
+	f, ok := p.fecSend[a]
+	if !ok {
+		f = &fecParity{}
+		p.fecSend[a] = f
+	}
+	f.acc = xorFrame(f.acc, stream, buf)
+	f.count += 1
+	if f.count < p.config.FECGroup {
+		return nil
+	}
+	parity := f.acc
+	f.acc = nil
+	f.count = 0
+	return parity
+}
+
+// Hands over data from a, or recovers lost data from parity covering the
+// parity sequence numbers up to seq.
+func (p *peer) receive(a address, seq uint64, parity int, m PeerMsg,
+	data chan PeerMsg) {
+	if parity > 0 {
+		p.recover(a, m.PeerId, seq, parity, m.Buf, data)
+		return
+	}
+	if f, ok := p.fecRecv[a]; ok && seq > 0 {
+		if _, ok := f.got[seq]; ok {
+			p.logDebug("dropping duplicate data", seq)
+			return
+		}
+		f.got[seq] = m
+		f.highest = max(f.highest, seq)
+		delete(f.got, seq-fecWindow)
+	}
+	p.deliver(a, seq, m, data)
+}
+
+func (p *peer) recover(a address, id uint64, seq uint64, parity int,
+	buf []byte, data chan PeerMsg) {
+	if parity > fecMaxGroup || uint64(parity) > seq {
+		p.logWarn("ignoring parity over", parity, "datagrams")
+		return
+	}
+	f, ok := p.fecRecv[a]
+	if !ok {
+		// Data before the first parity was not kept.
+		p.fecRecv[a] = &fecReceived{got: make(map[uint64]PeerMsg)}
+		return
+	}
+	missing := uint64(0)
+	acc := append([]byte(nil), buf...)
+	for s := seq - uint64(parity) + 1; s <= seq; s++ {
+		m, ok := f.got[s]
+		if !ok {
+			if missing != 0 {
+				return
+			}
+			missing = s
+			continue
+		}
+		acc = xorFrame(acc, m.Stream, m.Buf)
+	}
+	if missing == 0 || len(acc) < fecHeaderSize {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(acc))
+	if len(acc) < fecHeaderSize+n {
+		p.logWarn("ignoring inconsistent parity from", addrFromKey(a))
+		return
+	}
+	recovered := PeerMsg{
+		PeerId: id,
+		Buf:    acc[fecHeaderSize : fecHeaderSize+n],
+		Stream: binary.BigEndian.Uint16(acc[2:]),
+	}
+	f.got[missing] = recovered
+	p.stats.Recovered += 1
+	p.deliver(a, missing, recovered, data)
+}
+
+// Forgets received data too old to be covered by parity still to come.
+func (p *peer) expireReceived() {
+	for _, f := range p.fecRecv {
+		for s, _ := range f.got {
+			if s+fecWindow < f.highest {
+				delete(f.got, s)
+			}
+		}
+	}
+}
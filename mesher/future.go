@@ -0,0 +1,85 @@
+package mesher
+
+import (
+	"errors"
+	"sync"
+)
+
+/******************************************************************************/
+/* FUTURES                                                                    */
+/******************************************************************************/
+
+var (
+	// A datagram was dropped, e.g. because its send queue overflowed.
+	ErrDropped = errors.New("mesher: dropped")
+	// A datagram was still queued at its deadline.
+	ErrExpired = errors.New("mesher: deadline passed")
+)
+
+// The outcome of a send, see PeerHandle.SendAsync.
+type Future struct {
+	mu      sync.Mutex
+	pending int
+	err     error
+	done    chan struct{}
+}
+
+// Pending until resolved once, plus once per added datagram.
+func newFuture() *Future {
+	return &Future{pending: 1, done: make(chan struct{})}
+}
+
+func (f *Future) add() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending += 1
+}
+
+func (f *Future) resolve(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	f.pending -= 1
+	if f.pending == 0 {
+		close(f.done)
+	}
+}
+
+// Closed once every datagram of the send was written or dropped.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// The first failure of the send, nil if all datagrams were written. Only
+// final once Done is closed.
+func (f *Future) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Adds a datagram to the send's future, if any, returning what resolves
+// it.
+func (o outgoing) track() func(error) {
+	if o.future == nil {
+		return nil
+	}
+	o.future.add()
+	return o.future.resolve
+}
+
+// Called once all datagrams of the send are queued.
+func (o outgoing) queued(err error) {
+	if o.future != nil {
+		o.future.resolve(err)
+	}
+}
+
+// Reports the outcome of writing the response.
+func (r response) written(err error) {
+	if r.sent != nil {
+		r.sent(err)
+	}
+}
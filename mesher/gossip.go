@@ -0,0 +1,146 @@
+package mesher
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+/******************************************************************************/
+/* GOSSIP                                                                     */
+/******************************************************************************/
+
+// Data on this stream is gossip, framed by gossipFrame, see
+// PeerConfig.Fanout. The application must not send on it.
+const gossipStream = 0xffff
+
+var ErrReservedStream = errors.New("mesher: stream reserved for gossip")
+
+// How often gossip is passed on at most, and how long peers remember
+// gossip they passed on.
+const (
+	maxGossipHops = 8
+	gossipMemory  = 30 * time.Second
+)
+
+// Gossip is told apart by the address the server sees its origin at, and
+// a sequence number per origin.
+type gossipId struct {
+	origin address
+	seq    uint64
+}
+
+const gossipHeaderSize = len(address{}) + 8 + 1 + 2
+
+// Frames data on stream for gossip from origin with seq that may be
+// passed on hops more times.
+func gossipFrame(id gossipId, hops int, stream uint16, data []byte) []byte {
+	buf := make([]byte, gossipHeaderSize, gossipHeaderSize+len(data))
+	copy(buf, id.origin[:])
+	binary.BigEndian.PutUint64(buf[len(address{}):], id.seq)
+	buf[len(address{})+8] = byte(hops)
+	binary.BigEndian.PutUint16(buf[len(address{})+9:], stream)
+	return append(buf, data...)
+}
+
+// Whether broadcasting o gossips, rather than sending to every peer. Needs
+// the address the server sees the peer at to tell its gossip apart.
+func (p *peer) gossips(o outgoing) bool {
+	return p.config.Fanout > 0 && !p.unverifiedGossip() && o.ack == 0 &&
+		o.stream != gossipStream && p.publicAddr != (address{})
+}
+
+// Whether gossip would bypass AuthDirect or EndToEnd. Both only cover the
+// last hop of gossip, while its origin is whatever its frame claims.
+func (p *peer) unverifiedGossip() bool {
+	return p.config.AuthDirect || p.config.EndToEnd
+}
+
+// Sends o to Fanout random peers, who pass it on.
+func (p *peer) gossip(o outgoing, responses chan response) error {
+	p.gossipSeq += 1
+	id := gossipId{p.publicAddr, p.gossipSeq}
+	p.gossiped[id] = p.config.Clock.Now()
+	o.buf = gossipFrame(id, maxGossipHops, o.stream, o.buf)
+	o.stream = gossipStream
+	p.spread(o, address{}, responses)
+	return nil
+}
+
+// Sends the gossip o to Fanout random peers other than except and the
+// gossip's origin.
+func (p *peer) spread(o outgoing, except address, responses chan response) {
+	var origin address
+	copy(origin[:], o.buf)
+	targets := make([]address, 0, len(p.peerIds))
+	for a := range p.peerIds {
+		if a != except && a != origin && p.broadcastsTo(a, o) {
+			targets = append(targets, a)
+		}
+	}
+	rand.Shuffle(len(targets), func(i, j int) {
+		targets[i], targets[j] = targets[j], targets[i]
+	})
+	for _, a := range targets[:min(p.config.Fanout, len(targets))] {
+		p.sendTo(a, o, responses)
+	}
+}
+
+// Called with gossip m from the peer at from. Hands it over once, as data
+// of its origin, and passes it on while it has hops left.
+func (p *peer) gossipReceived(from address, m PeerMsg, data chan PeerMsg) {
+	if len(m.Buf) < gossipHeaderSize {
+		p.logWarn("dropping truncated gossip from", addrFromKey(from))
+		p.drops.decodeError.Add(1)
+		return
+	}
+	if p.unverifiedGossip() {
+		p.logWarn("dropping gossip from", addrFromKey(from),
+			"its origin cannot be verified")
+		p.drops.authFailed.Add(1)
+		return
+	}
+	var id gossipId
+	copy(id.origin[:], m.Buf)
+	id.seq = binary.BigEndian.Uint64(m.Buf[len(address{}):])
+	hops := int(m.Buf[len(address{})+8])
+	stream := binary.BigEndian.Uint16(m.Buf[len(address{})+9:])
+	if _, ok := p.gossiped[id]; ok || id.origin == p.publicAddr {
+		return
+	}
+	p.gossiped[id] = p.config.Clock.Now()
+	if origin, ok := p.peerIds[id.origin]; ok {
+		p.handOver(PeerMsg{PeerId: origin, Buf: m.Buf[gossipHeaderSize:],
+			Stream: stream}, data)
+	} else {
+		p.logDebug("dropping gossip of unknown origin",
+			addrFromKey(id.origin))
+	}
+	if hops > 1 {
+		buf := gossipFrame(id, min(hops-1, maxGossipHops), stream,
+			m.Buf[gossipHeaderSize:])
+		p.spread(outgoing{buf: buf, stream: gossipStream, via: m.via}, from,
+			p.responses)
+	}
+}
+
+// Forgets gossip passed on more than gossipMemory ago.
+func (p *peer) expireGossip() {
+	now := p.config.Clock.Now()
+	for id, t := range p.gossiped {
+		if now.Sub(t) > gossipMemory {
+			delete(p.gossiped, id)
+		}
+	}
+}
+
+// The address of the peer with id, zero if unknown.
+func (p *peer) addressOf(id uint64) address {
+	for a, i := range p.peerIds {
+		if i == id {
+			return a
+		}
+	}
+	return address{}
+}
@@ -0,0 +1,26 @@
+package mesher
+
+import "testing"
+
+// Gossip claims its origin unchecked, so it must not pass for data
+// authenticated or encrypted by that origin.
+func TestUnverifiedGossipDropped(t *testing.T) {
+	p := testPeer(PeerConfig{Fanout: 4, AuthDirect: true})
+	p.publicAddr = addrKey(testAddr(1))
+	from := testAddr(2)
+	p.testLearn(from)
+	p.testLearn(testAddr(3))
+	if p.gossips(outgoing{buf: []byte("hi")}) {
+		t.Errorf("gossips with AuthDirect")
+	}
+
+	id := gossipId{addrKey(testAddr(3)), 1}
+	m := PeerMsg{Buf: gossipFrame(id, 3, 0, []byte("hi"))}
+	p.gossipReceived(addrKey(from), m, p.data)
+	if len(p.data) != 0 || len(p.testSent()) != 0 {
+		t.Errorf("gossip claiming another origin was handed over or passed on")
+	}
+	if p.drops.authFailed.Load() != 1 {
+		t.Errorf("%d gossip dropped, want 1", p.drops.authFailed.Load())
+	}
+}
@@ -0,0 +1,21 @@
+package mesher
+
+/******************************************************************************/
+/* GROUPS                                                                     */
+/******************************************************************************/
+
+// Whether the broadcast o goes to the peer at a, see BroadcastToGroup.
+func (p *peer) inGroup(a address, o outgoing) bool {
+	return o.group == "" || p.groups[a] == o.group
+}
+
+// Broadcasts data like the broadcast channel, but only to the peers
+// advertising group, see PeerConfig.Group.
+func (h *PeerHandle) BroadcastToGroup(group string, data []byte) error {
+	select {
+	case h.sends <- outgoing{buf: data, group: group}:
+		return nil
+	case <-h.stopped:
+		return ErrStopped
+	}
+}
@@ -0,0 +1,41 @@
+package mesher
+
+import "testing"
+
+// Peers learn groups from the server's peer list, before any keep-alive.
+func TestGroupsListed(t *testing.T) {
+	s := testServer(ServerConfig{})
+	replies := make(chan response, 16)
+	for i, group := range []string{"", "red", ""} {
+		m := getPeerList{Version: ProtocolVersion, Group: group}
+		m.updateServer(s, testAddr(3-i), replies)
+	}
+	var list peerList
+	for len(replies) > 0 {
+		r := <-replies
+		if addrKey(r.to) == addrKey(testAddr(1)) {
+			list = r.m.(peerList)
+		}
+	}
+	if len(list.Addresses) != 2 || len(list.Groups) != 2 {
+		t.Fatalf("listed %d peers with %d groups, want 2 and 2",
+			len(list.Addresses), len(list.Groups))
+	}
+
+	p := testPeer(PeerConfig{})
+	list.updatePeer(p, testAddr(0), p.responses, p.data)
+	p.testSent()
+	p.broadcast(outgoing{buf: []byte("data"), group: "red"}, p.responses)
+	sent := p.testSent()
+	if len(sent) != 1 {
+		t.Fatalf("group broadcast sent %d datagrams, want 1", len(sent))
+	}
+	to := addrKey(sent[0].to)
+	if m, ok := sent[0].m.(dataRelayTo); ok {
+		to = m.To
+	}
+	if to != addrKey(testAddr(2)) {
+		t.Errorf("group broadcast went to %v, want %v", addrFromKey(to),
+			testAddr(2))
+	}
+}
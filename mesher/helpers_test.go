@@ -0,0 +1,70 @@
+package mesher
+
+import (
+	"net"
+	"net/netip"
+	"time"
+)
+
+// A Clock for tests that only moves when told to. Timers never fire.
+type testClock struct {
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{time.Unix(1700000000, 0)}
+}
+
+func (c *testClock) Now() time.Time                         { return c.now }
+func (c *testClock) After(d time.Duration) <-chan time.Time { return nil }
+func (c *testClock) Tick(d time.Duration) <-chan time.Time  { return nil }
+func (c *testClock) Advance(d time.Duration)                { c.now = c.now.Add(d) }
+
+// The address of node i of a test.
+func testAddr(i int) *net.UDPAddr {
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(
+		netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 8000))
+}
+
+// A peer of the server at testAddr(0), listening on testAddr(1), that is
+// not running: tests call its methods and read what it queued.
+func testPeer(config PeerConfig) *peer {
+	if config.Clock == nil {
+		config.Clock = newTestClock()
+	}
+	if config.PeerTimeout == 0 {
+		config.PeerTimeout = defaultPeerTimeout
+	}
+	p := newPeer(config, testAddr(1).AddrPort(),
+		[]*net.UDPAddr{testAddr(0)}, nil, make(chan struct{}, 1),
+		make(chan response, 1024), make(chan PeerMsg, 1024),
+		make(chan PeerEvent, 1024), &dropCounters{}, nil, newKeyring(config))
+	// Nothing watches, so seen addresses must not block.
+	p.seenPeerAlive = make(chan *net.UDPAddr, 1024)
+	return p
+}
+
+// Makes the peer at a known to p, returning its id.
+func (p *peer) testLearn(a *net.UDPAddr) uint64 {
+	p.peerIds[addrKey(a)] = p.nextPeerId
+	p.nextPeerId += 1
+	return p.peerIds[addrKey(a)]
+}
+
+// Everything p queued to send.
+func (p *peer) testSent() []response {
+	var sent []response
+	for len(p.responses) > 0 {
+		sent = append(sent, <-p.responses)
+	}
+	return sent
+}
+
+// A server at testAddr(0) that is not running, like testPeer.
+func testServer(config ServerConfig) *server {
+	if config.Clock == nil {
+		config.Clock = newTestClock()
+	}
+	return newServer(config, make(chan *net.UDPAddr, 1024),
+		make(chan response, 1024), &dropCounters{}, nil, newSecret())
+}
@@ -0,0 +1,45 @@
+package mesher
+
+import (
+	"time"
+)
+
+/******************************************************************************/
+/* IDLE                                                                       */
+/******************************************************************************/
+
+// Whether keep-alives are due this tick, see PeerConfig.IdleAfter. Each
+// keep-alive round while idle doubles the interval to the next one, up to
+// MaxIdleInterval.
+func (p *peer) keepAliveDue() bool {
+	if p.config.IdleAfter <= 0 {
+		return true
+	}
+	now := p.config.Clock.Now()
+	if now.Sub(p.lastActive) < p.config.IdleAfter {
+		p.idleInterval = 0
+		return true
+	}
+	if now.Sub(p.lastKeepAlive) < p.idleInterval {
+		return false
+	}
+	if p.idleInterval == 0 {
+		p.logInfo("idle, backing off keep-alives")
+	}
+	p.idleInterval = min(max(2*p.idleInterval, time.Second),
+		p.config.MaxIdleInterval)
+	p.lastKeepAlive = now
+	return true
+}
+
+// Called on every application send. Ends idle backoff with a round of
+// keep-alives, to get back direct paths lost meanwhile.
+func (p *peer) active(responses chan response) {
+	p.lastActive = p.config.Clock.Now()
+	if p.idleInterval == 0 {
+		return
+	}
+	p.logInfo("active again, keeping alive every tick")
+	p.idleInterval = 0
+	p.keepAlive(responses)
+}
@@ -0,0 +1,116 @@
+package mesher
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"net"
+	"strings"
+	"sync"
+)
+
+/******************************************************************************/
+/* KEYRING                                                                    */
+/******************************************************************************/
+
+// The keys direct data is authenticated with and the keys shared with peers
+// for EndToEnd, with which the decoders check, open and decompress data
+// ahead of the peer goroutine. Only the peer goroutine changes them, under
+// the lock, so it reads them without.
+type keyring struct {
+	authDirect bool
+	endToEnd   bool
+	mu         sync.RWMutex
+	auth       map[address][]byte
+	shared     map[address]cipher.AEAD
+}
+
+func newKeyring(config PeerConfig) *keyring {
+	return &keyring{
+		authDirect: config.AuthDirect,
+		endToEnd:   config.EndToEnd,
+		auth:       make(map[address][]byte),
+		shared:     make(map[address]cipher.AEAD),
+	}
+}
+
+func (k *keyring) setAuth(a address, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.auth[a] = key
+}
+
+func (k *keyring) setShared(a address, aead cipher.AEAD) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.shared[a] = aead
+}
+
+func (k *keyring) forget(a address) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.auth, a)
+	delete(k.shared, a)
+}
+
+// What a decoder did to data ahead of the peer goroutine. Zero if it could
+// not, as a key was missing or the data was bad. The peer goroutine then
+// does it again itself, to count and report failures.
+type prepared struct {
+	verified bool
+	opened   bool
+	plain    []byte
+}
+
+// Checks, opens and decodes the data of m, if it is data.
+func (k *keyring) prepare(m peerRequest, from *net.UDPAddr) peerRequest {
+	switch d := m.(type) {
+	case dataDirect:
+		return k.prepareDirect(d, addrKey(from))
+	case dataOpaque:
+		d.dataDirect = k.prepareDirect(d.dataDirect, addrKey(from))
+		return d
+	case dataRelayedFrom:
+		d.pre.plain, d.pre.opened = k.open(d.From, d.Data, d.Codec)
+		return d
+	}
+	return m
+}
+
+func (k *keyring) prepareDirect(m dataDirect, a address) dataDirect {
+	if k.authDirect {
+		k.mu.RLock()
+		key, ok := k.auth[a]
+		k.mu.RUnlock()
+		if !ok || !hmac.Equal(m.MAC, m.mac(key)) {
+			return m
+		}
+		m.pre.verified = true
+	}
+	m.pre.plain, m.pre.opened = k.open(a, m.Data, m.Codec)
+	return m
+}
+
+// Like peer.openData, but silent.
+func (k *keyring) open(a address, buf []byte, codec string) ([]byte,
+	bool) {
+	if !strings.HasSuffix(codec, e2eSuffix) {
+		if k.endToEnd {
+			return nil, false
+		}
+		plain, err := unpack(buf, codec)
+		return plain, err == nil
+	}
+	k.mu.RLock()
+	aead, ok := k.shared[a]
+	k.mu.RUnlock()
+	if !ok || len(buf) < aead.NonceSize() {
+		return nil, false
+	}
+	nonce := buf[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, buf[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, false
+	}
+	plain, err = unpack(plain, strings.TrimSuffix(codec, e2eSuffix))
+	return plain, err == nil
+}
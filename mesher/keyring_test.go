@@ -0,0 +1,39 @@
+package mesher
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecodersPrepareData(t *testing.T) {
+	p := testPeer(PeerConfig{AuthDirect: true})
+	p.testLearn(testAddr(2))
+	key := p.receiveKey(addrKey(testAddr(2)))
+	data := bytes.Repeat([]byte("data"), 100)
+	packed, err := compress(CodecFlate, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := dataDirect{Data: packed, Codec: CodecFlate, Seq: 1, Origin: 3}
+	m.MAC = m.mac(key)
+	d := p.keys.prepare(m, testAddr(2)).(dataDirect)
+	if !d.pre.verified || !d.pre.opened || !bytes.Equal(d.pre.plain, data) {
+		t.Errorf("decoder did not verify and open the data")
+	}
+	d.updatePeer(p, testAddr(2), p.responses, p.data)
+	if len(p.data) != 1 || !bytes.Equal((<-p.data).Buf, data) {
+		t.Errorf("prepared data not handed over")
+	}
+
+	m.Seq = 2
+	m.MAC = make([]byte, authMACSize)
+	d = p.keys.prepare(m, testAddr(2)).(dataDirect)
+	if d.pre.verified || d.pre.opened {
+		t.Errorf("decoder passed a forged MAC")
+	}
+	d.updatePeer(p, testAddr(2), p.responses, p.data)
+	if len(p.data) != 0 || p.drops.authFailed.Load() != 1 {
+		t.Errorf("forged data handed over, %d failures counted",
+			p.drops.authFailed.Load())
+	}
+}
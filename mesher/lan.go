@@ -0,0 +1,141 @@
+package mesher
+
+import (
+	"bytes"
+	"net"
+	"sync"
+)
+
+/******************************************************************************/
+/* LAN                                                                        */
+/******************************************************************************/
+
+// Direct paths over the local network to peers behind the same NAT, see
+// PeerConfig.LocalPaths. Shared by the reader, which maps the private
+// addresses of such peers to their public ones, and the stage in front of
+// the writer, which maps them back. The rest of the peer only deals with
+// public addresses.
+type lanRoutes struct {
+	logger
+	mu sync.Mutex
+	// Public addresses by private address, as listed by the server.
+	public map[address]address
+	// Private addresses by public address, once heard from.
+	private map[address]*net.UDPAddr
+}
+
+func newLANRoutes(l logger) *lanRoutes {
+	return &lanRoutes{
+		logger:  l,
+		public:  make(map[address]address),
+		private: make(map[address]*net.UDPAddr),
+	}
+}
+
+func (l *lanRoutes) candidate(public, private address) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.public[private] = public
+}
+
+// Whether data to public goes over the local network.
+func (l *lanRoutes) routed(public address) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.private[public]
+	return ok
+}
+
+// Falls back to the public address until heard from privately again.
+func (l *lanRoutes) unroute(public address) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.private, public)
+}
+
+func (l *lanRoutes) forget(public address) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.private, public)
+	for private, p := range l.public {
+		if p == public {
+			delete(l.public, private)
+		}
+	}
+}
+
+// The public address of the sender of a datagram from from. Hearing from a
+// candidate confirms the local path.
+func (l *lanRoutes) inbound(from *net.UDPAddr) *net.UDPAddr {
+	if l == nil {
+		return from
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	public, ok := l.public[addrKey(from)]
+	if !ok {
+		return from
+	}
+	if _, ok := l.private[public]; !ok {
+		l.logInfo("local path to", addrFromKey(public), "via", from)
+		l.private[public] = from
+	}
+	return addrFromKey(public)
+}
+
+// Sends responses to peers with a local path there instead.
+func (l *lanRoutes) outbound(in chan response) chan response {
+	out := make(chan response, channelCapacity)
+	go func() {
+		defer live()()
+		for m := range in {
+			if m.to != nil {
+				l.mu.Lock()
+				if private, ok := l.private[addrKey(m.to)]; ok {
+					m.to = private
+				}
+				l.mu.Unlock()
+			}
+			out <- m
+		}
+		close(out)
+	}()
+	return out
+}
+
+// The address the peer advertises to peers behind the same NAT: the one it
+// is bound to, or else the lowest private one of its interfaces.
+func (p *peer) privateAddress() address {
+	if !p.config.LocalPaths {
+		return address{}
+	}
+	var best address
+	for a, _ := range p.self {
+		ip := addrPortFromKey(a).Addr().Unmap()
+		if !ip.IsPrivate() {
+			continue
+		}
+		if best == (address{}) || bytes.Compare(a[:], best[:]) < 0 {
+			best = a
+		}
+	}
+	return best
+}
+
+// Also keeps alive the private address of peers behind the same NAT, until
+// the local path is confirmed.
+func (p *peer) probeLocal(a address, responses chan response) {
+	private, ok := p.privates[a]
+	if !ok || p.lan.routed(a) {
+		return
+	}
+	responses <- response{
+		to: addrFromKey(private),
+		m:  p.keepAliveFor(a),
+	}
+}
+
+// Whether a and b share the public IP.
+func sameNAT(a, b address) bool {
+	return bytes.Equal(a[:16], b[:16])
+}
@@ -0,0 +1,61 @@
+package mesher
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+/******************************************************************************/
+/* LOGGING                                                                    */
+/******************************************************************************/
+
+// The severity of a log message, see PeerConfig.LogLevel.
+type LogLevel int32
+
+const (
+	// Routine traffic and goroutines shutting down.
+	LogDebug LogLevel = iota
+	// Changes of the mesh, e.g. peers discovered or paths switched.
+	LogInfo
+	// Dropped data, misbehaving peers and ignored settings.
+	LogWarn
+	// Failing sockets and files.
+	LogError
+)
+
+var logLevel atomic.Int32
+
+// Logs only messages of at least level from now on, for all nodes of the
+// process, like the standard logger they log to, on top of the LogLevel of
+// each node. Everything is logged by default.
+func SetLogLevel(level LogLevel) {
+	logLevel.Store(int32(level))
+}
+
+func logAt(level LogLevel, v ...any) {
+	if int32(level) >= logLevel.Load() {
+		log.Println(v...)
+	}
+}
+
+func logDebug(v ...any) { logAt(LogDebug, v...) }
+func logInfo(v ...any)  { logAt(LogInfo, v...) }
+func logWarn(v ...any)  { logAt(LogWarn, v...) }
+func logError(v ...any) { logAt(LogError, v...) }
+
+// Logs the messages of one node of at least its level, see
+// PeerConfig.LogLevel. Embedded by what logs on behalf of a node.
+type logger struct {
+	level LogLevel
+}
+
+func (l logger) logAt(level LogLevel, v ...any) {
+	if level >= l.level {
+		logAt(level, v...)
+	}
+}
+
+func (l logger) logDebug(v ...any) { l.logAt(LogDebug, v...) }
+func (l logger) logInfo(v ...any)  { l.logAt(LogInfo, v...) }
+func (l logger) logWarn(v ...any)  { l.logAt(LogWarn, v...) }
+func (l logger) logError(v ...any) { l.logAt(LogError, v...) }
@@ -0,0 +1,27 @@
+package mesher
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Nodes of one process log at their own levels.
+func TestLogLevelPerNode(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	quiet, verbose := logger{LogWarn}, logger{LogDebug}
+	quiet.logInfo("quiet info")
+	quiet.logWarn("quiet warning")
+	verbose.logInfo("verbose info")
+	for want, logged := range map[string]bool{
+		"quiet info": false, "quiet warning": true, "verbose info": true,
+	} {
+		if strings.Contains(out.String(), want) != logged {
+			t.Errorf("%q logged: %v, want %v", want, !logged, logged)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package mesher
+
+import (
+	"net"
+	"slices"
+)
+
+/******************************************************************************/
+/* LOOPS                                                                      */
+/******************************************************************************/
+
+// Cap on the servers relaying the same data, in case ids collide or tags
+// are lost along a cycle.
+const maxRelayHops = 8
+
+// Whether data relayed by the servers via comes back around, e.g. through
+// a node acting as peer of one server and forwarding to another. Such data
+// is dropped. Peers pass on via with the gossip they pass on, see
+// gossipReceived, so gossip coming back around is dropped as well.
+func (s *server) looped(from *net.UDPAddr, stream uint16,
+	via []uint64) bool {
+	via = s.passedOn(stream, via)
+	if !slices.Contains(via, s.id) && len(via) < maxRelayHops {
+		return false
+	}
+	s.logWarn("dropping relay loop from", from, "via", len(via), "servers")
+	s.drops.looped.Add(1)
+	return true
+}
+
+// via with this server added.
+func (s *server) via(stream uint16, via []uint64) []uint64 {
+	return append(slices.Clone(s.passedOn(stream, via)), s.id)
+}
+
+// via without this server, if gossip last passed it: a peer passing gossip
+// on via the server it got it from is no loop.
+func (s *server) passedOn(stream uint16, via []uint64) []uint64 {
+	if stream == gossipStream && len(via) > 0 && via[len(via)-1] == s.id {
+		return via[:len(via)-1]
+	}
+	return via
+}
@@ -0,0 +1,99 @@
+package mesher
+
+import (
+	"slices"
+	"testing"
+)
+
+func relayServer(peers ...int) *server {
+	s := &server{
+		config: ServerConfig{Clock: newTestClock()},
+		peers:  make(map[address]struct{}),
+		drops:  &dropCounters{},
+		id:     7,
+	}
+	for _, i := range peers {
+		s.peers[addrKey(testAddr(i))] = struct{}{}
+	}
+	return s
+}
+
+func relayed(s *server, m dataRelayTo) []response {
+	replies := make(chan response, 1)
+	m.updateServer(s, testAddr(1), replies)
+	close(replies)
+	var out []response
+	for r := range replies {
+		out = append(out, r)
+	}
+	return out
+}
+
+func TestRelayLoopDropped(t *testing.T) {
+	s := relayServer(1, 2)
+	to := addrKey(testAddr(2))
+	out := relayed(s, dataRelayTo{To: to, Via: []uint64{3}})
+	if len(out) != 1 {
+		t.Fatalf("relayed %d datagrams, want 1", len(out))
+	}
+	via := out[0].m.(dataRelayedFrom).Via
+	if !slices.Equal(via, []uint64{3, 7}) {
+		t.Errorf("relayed via %v, want [3 7]", via)
+	}
+
+	out = relayed(s, dataRelayTo{To: to, Via: []uint64{3, 7}})
+	if len(out) != 0 || s.drops.looped.Load() != 1 {
+		t.Errorf("loop through the server relayed %d datagrams, %d looped",
+			len(out), s.drops.looped.Load())
+	}
+}
+
+func TestGossipLoopDropped(t *testing.T) {
+	s := relayServer(1, 2)
+	to := addrKey(testAddr(2))
+	out := relayed(s, dataRelayTo{To: to, Stream: gossipStream,
+		Via: []uint64{3, 7}})
+	if len(out) != 1 {
+		t.Fatalf("gossip passed on via the server it came from was dropped")
+	}
+	via := out[0].m.(dataRelayedFrom).Via
+	if !slices.Equal(via, []uint64{3, 7}) {
+		t.Errorf("relayed gossip via %v, want [3 7]", via)
+	}
+
+	out = relayed(s, dataRelayTo{To: to, Stream: gossipStream,
+		Via: []uint64{7, 3}})
+	if len(out) != 0 {
+		t.Errorf("gossip coming back around through the server relayed")
+	}
+	via = make([]uint64, maxRelayHops)
+	out = relayed(s, dataRelayTo{To: to, Stream: gossipStream, Via: via})
+	if len(out) != 0 {
+		t.Errorf("gossip relayed more than %d times", maxRelayHops)
+	}
+}
+
+// A hybrid loop: a server relays gossip to a peer passing it on via the
+// same server. The server must see itself in what the peer passes on.
+func TestGossipCarriesVia(t *testing.T) {
+	p := testPeer(PeerConfig{Fanout: 4})
+	from := testAddr(2)
+	p.testLearn(from)
+	p.testLearn(testAddr(3))
+	id := gossipId{addrKey(from), 1}
+	m := PeerMsg{Buf: gossipFrame(id, 3, 0, []byte("hi")),
+		via: []uint64{7}}
+	p.gossipReceived(addrKey(from), m, p.data)
+
+	sent := p.testSent()
+	if len(sent) != 1 {
+		t.Fatalf("passed gossip on %d times, want 1", len(sent))
+	}
+	relay, ok := sent[0].m.(dataRelayTo)
+	if !ok {
+		t.Fatalf("passed gossip on as %s", messageName(sent[0].m))
+	}
+	if !slices.Equal(relay.Via, []uint64{7}) {
+		t.Errorf("passed gossip on via %v, want [7]", relay.Via)
+	}
+}
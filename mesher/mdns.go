@@ -0,0 +1,178 @@
+package mesher
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/******************************************************************************/
+/* MDNS                                                                       */
+/******************************************************************************/
+
+// Service servers advertise and peers look up, see ServerConfig.MDNS.
+const mdnsService = "_mesher._udp.local."
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// How long a peer waits for servers to answer each query, and how often it
+// asks.
+const (
+	mdnsTimeout = time.Second
+	mdnsQueries = 3
+)
+
+var errNoMDNSServer = errors.New("no server answered on mDNS")
+
+// Answers queries for mdnsService with the port of the server, until it
+// stopped. Peers take the address from the source of the answer.
+func advertiseMDNS(port uint16, stopped chan struct{}, l logger) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		log.Fatal(err)
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "mesher"
+	}
+	host = strings.Split(host, ".")[0]
+	instance := host + "." + mdnsService
+	target := host + ".local."
+	l.logInfo("advertising", instance, "port", port, "on mDNS")
+	go func() {
+		defer live()()
+		<-stopped
+		conn.Close()
+	}()
+	go func() {
+		defer live()()
+		buf := make([]byte, maxDatagram)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil || query.Header.Response ||
+				!asksForService(query.Questions) {
+				continue
+			}
+			reply, err := mdnsAnswer(query, instance, target, port)
+			if err != nil {
+				l.logError("cannot build mDNS answer:", err)
+				continue
+			}
+			// Peers query from ephemeral ports, so answers go back to them
+			// rather than to the group.
+			conn.WriteToUDP(reply, from)
+		}
+		l.logDebug("advertiseMDNS shutting down")
+	}()
+}
+
+func asksForService(questions []dnsmessage.Question) bool {
+	for _, q := range questions {
+		if (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL) &&
+			strings.EqualFold(q.Name.String(), mdnsService) {
+			return true
+		}
+	}
+	return false
+}
+
+func mdnsAnswer(query dnsmessage.Message, instance, target string,
+	port uint16) ([]byte, error) {
+	service := dnsmessage.MustNewName(mdnsService)
+	name, err := dnsmessage.NewName(instance)
+	if err != nil {
+		return nil, err
+	}
+	targetName, err := dnsmessage.NewName(target)
+	if err != nil {
+		return nil, err
+	}
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:            query.Header.ID,
+			Response:      true,
+			Authoritative: true,
+		},
+		Questions: query.Questions,
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name:  service,
+				Class: dnsmessage.ClassINET,
+				TTL:   120,
+			},
+			Body: &dnsmessage.PTRResource{PTR: name},
+		}, {
+			Header: dnsmessage.ResourceHeader{
+				Name:  name,
+				Class: dnsmessage.ClassINET,
+				TTL:   120,
+			},
+			Body: &dnsmessage.SRVResource{Target: targetName, Port: port},
+		}},
+	}
+	return m.Pack()
+}
+
+// The address of the server answering a query for mdnsService first, which
+// is the one with the lowest latency.
+func resolveMDNS(l logger) (*net.UDPAddr, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	query, err := (&dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(mdnsService),
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		}},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDatagram)
+	for i := 0; i < mdnsQueries; i++ {
+		_, err = conn.WriteToUDP(query, mdnsGroup)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(mdnsTimeout))
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			if port, ok := advertisedPort(buf[:n]); ok {
+				l.logInfo("found server", from.IP, "port", port, "on mDNS")
+				return &net.UDPAddr{IP: from.IP, Port: int(port)}, nil
+			}
+		}
+	}
+	return nil, errNoMDNSServer
+}
+
+// The port in an answer naming a server of mdnsService.
+func advertisedPort(buf []byte) (uint16, bool) {
+	var m dnsmessage.Message
+	if m.Unpack(buf) != nil || !m.Header.Response {
+		return 0, false
+	}
+	for _, r := range append(m.Answers, m.Additionals...) {
+		srv, ok := r.Body.(*dnsmessage.SRVResource)
+		if ok && strings.HasSuffix(strings.ToLower(r.Header.Name.String()),
+			"."+mdnsService) {
+			return srv.Port, true
+		}
+	}
+	return 0, false
+}
@@ -2,11 +2,24 @@ package mesher
 
 import (
 	"bytes"
+	"cmp"
+	"container/list"
+	"crypto/ecdh"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
 	"net"
 	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +35,14 @@ type request struct {
 type response struct {
 	to *net.UDPAddr
 	m  interface{}
+	// Dropped instead of sent, if still queued after the deadline.
+	deadline time.Time
+	// Called with the outcome, if set, see written.
+	sent func(err error)
+	// See SendOptions.Priority.
+	priority int
+	// Failed writes so far, see retryBuffer.
+	retries int
 }
 
 // TODO net.UDPAddr as map-key. Alternative?
@@ -47,15 +68,123 @@ func addrFromKey(a address) *net.UDPAddr {
 	return net.UDPAddrFromAddrPort(addr)
 }
 
-func watchdog(addr *net.UDPAddr, timeout chan *net.UDPAddr) chan struct{} {
+// Largest datagram accepted for decoding. Matches the reader's buffer.
+const maxMessageSize = 65536
+
+// Walks the length-prefixed messages of a gob stream and rejects it, if a
+// declared length does not fit into the remaining bytes. This keeps crafted
+// headers from making the decoder allocate for data that is not there.
+func checkFraming(buf []byte) error {
+	for len(buf) > 0 {
+		n, width, err := gobUint(buf)
+		if err != nil {
+			return err
+		}
+		buf = buf[width:]
+		if n == 0 || n > uint64(len(buf)) {
+			return fmt.Errorf("implausible gob message length %d, %d bytes left",
+				n, len(buf))
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+func gobUint(buf []byte) (uint64, int, error) {
+	b := buf[0]
+	if b <= 0x7f {
+		return uint64(b), 1, nil
+	}
+	n := -int(int8(b))
+	if n > 8 || n+1 > len(buf) {
+		return 0, 0, errors.New("invalid gob uint")
+	}
+	var x uint64
+	for _, c := range buf[1 : n+1] {
+		x = x<<8 | uint64(c)
+	}
+	return x, n + 1, nil
+}
+
+func decode(buf []byte, m interface{}) (err error) {
+	if len(buf) > maxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds %d", len(buf),
+			maxMessageSize)
+	}
+	err = checkFraming(buf)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decode panic: %v", r)
+		}
+	}()
+	dec := gob.NewDecoder(bytes.NewReader(buf))
+	return dec.Decode(m)
+}
+
+// The datagram socket mesher reads from and writes to. *net.UDPConn
+// implements it, tests may substitute an in-memory network.
+type Transport interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// Source of time for timeouts and tickers, so tests can control it.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Tick(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Tick(d time.Duration) <-chan time.Time  { return time.Tick(d) }
+
+func clockOrDefault(c Clock) Clock {
+	if c == nil {
+		return realClock{}
+	}
+	return c
+}
+
+// Name of a message type, as used to key statistics.
+func messageName(m interface{}) string {
+	return reflect.TypeOf(m).Name()
+}
+
+func addrPortFromKey(a address) netip.AddrPort {
+	addr := addrFromKey(a)
+	if addr == nil {
+		return netip.AddrPort{}
+	}
+	return addr.AddrPort()
+}
+
+func watchdog(clock Clock, addr *net.UDPAddr, after time.Duration,
+	timeout chan *net.UDPAddr, quit chan struct{}, l logger) chan struct{} {
 	channel := make(chan struct{})
 	go func() {
+		defer live()()
 		for {
 			select {
 			case <-channel:
-			case <-time.After(5 * time.Second):
-				log.Println("watchdog timeout", addr)
-				timeout <- addr
+			case <-clock.After(after):
+				l.logDebug("watchdog timeout", addr)
+				select {
+				case timeout <- addr:
+					return
+				case <-channel:
+					// Seen again meanwhile, keep watching.
+				case <-quit:
+					return
+				}
+			case <-quit:
 				return
 			}
 		}
@@ -63,72 +192,273 @@ func watchdog(addr *net.UDPAddr, timeout chan *net.UDPAddr) chan struct{} {
 	return channel
 }
 
-func reader(conn *net.UDPConn) chan request {
-	requests := make(chan request)
+// Internal goroutines currently running, see Stats.Goroutines.
+var goroutines atomic.Int64
+
+// Counts the calling goroutine as running until the returned function is
+// called, meant to be deferred first thing.
+func live() func() {
+	goroutines.Add(1)
+	return func() { goroutines.Add(-1) }
+}
+
+// How long the watcher awaits outstanding timeouts on shutdown. The main
+// loops give up on the watcher after twice as long.
+const drainTimeout = 10 * time.Second
+
+// Separates mesher datagrams from those of other protocols sharing the
+// socket by a magic prefix. Without a magic every datagram is mesher's.
+// Past the magic, datagrams exchanged with the server may be sealed.
+type framing struct {
+	logger
+	magic   []byte
+	foreign func(data []byte, from *net.UDPAddr)
+	sealing *sealing
+	lan     *lanRoutes
+	capture *pcapWriter
+}
+
+// Strips the magic. Returns false for foreign datagrams, after passing them
+// to the foreign handler, if any. Sealed datagrams are opened by the
+// decoders.
+func (f framing) strip(buf []byte, from *net.UDPAddr) ([]byte, bool) {
+	if bytes.HasPrefix(buf, f.magic) {
+		return buf[len(f.magic):], true
+	}
+	if f.foreign != nil {
+		f.foreign(buf, from)
+	}
+	return nil, false
+}
+
+// Reads batch datagrams per system call where supported, one otherwise.
+// Counts itself in running until it exited.
+func reader(conn Transport, batch int, f framing,
+	running *sync.WaitGroup) chan request {
+	requests := make(chan request, channelCapacity)
+	deliver := func(buf []byte, from *net.UDPAddr) {
+		f.capture.received(conn, from, buf)
+		buf, ok := f.strip(buf, from)
+		if ok {
+			requests <- request{f.lan.inbound(from), buf}
+		}
+	}
+	running.Add(1)
 	go func() {
-		for {
-			buf := make([]byte, 65536)
-			n, from, err := conn.ReadFromUDP(buf)
-			if err != nil {
-				break
+		defer running.Done()
+		defer live()()
+		if batch <= 1 || !readBatches(conn, batch, deliver) {
+			for {
+				buf := make([]byte, maxMessageSize)
+				n, from, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					break
+				}
+				deliver(buf[:n], from)
 			}
-			requests <- request{from, buf[:n]}
 		}
-		log.Println("reader shutting down, closing 'requests'-channel")
+		f.logDebug("reader shutting down, closing 'requests'-channel")
 		close(requests)
 	}()
 	return requests
 }
 
-func writer(conn *net.UDPConn, out chan response) chan struct{} {
+// Encodes a response into a datagram. Returns false for responses to drop.
+func encodeResponse(m response, maxDatagram int, clock Clock,
+	f framing, drops *dropCounters) ([]byte, bool) {
+	if m.to == nil {
+		m.written(ErrDropped)
+		return nil, false
+	}
+	if !m.deadline.IsZero() && clock.Now().After(m.deadline) {
+		f.logDebug("dropping", messageName(m.m), "to", m.to,
+			"past its deadline")
+		m.written(ErrExpired)
+		return nil, false
+	}
+	var b bytes.Buffer
+	b.Write(f.magic)
+	if o, ok := m.m.(dataOpaque); ok {
+		b.Write(o.frame())
+	} else {
+		enc := gob.NewEncoder(&b)
+		err := enc.Encode(&m.m)
+		if err != nil {
+			log.Fatal("encode:", err)
+		}
+	}
+	buf := b.Bytes()
+	if f.sealing.applies(m.to) {
+		buf = append(buf[:len(f.magic):len(f.magic)],
+			f.sealing.seal(buf[len(f.magic):])...)
+	}
+	if len(buf) > maxDatagram {
+		f.logWarn("dropping datagram of", len(buf), "bytes to", m.to,
+			"exceeding", maxDatagram)
+		drops.tooLarge.Add(1)
+		m.written(ErrDropped)
+		return nil, false
+	}
+	return buf, true
+}
+
+// Writes batch datagrams per system call where supported, one otherwise.
+// A batch holds what is queued at the time, after waiting up to window for
+// more.
+func writer(conn Transport, out chan response, maxDatagram int, clock Clock,
+	batch int, window time.Duration, f framing, retries *retryBuffer,
+	drops *dropCounters) chan struct{} {
 	done := make(chan struct{})
 	go func() {
-		for m := range out {
-			if m.to == nil {
-				continue
+		defer live()()
+		encode := func(m response) ([]byte, bool) {
+			b, ok := encodeResponse(m, maxDatagram, clock, f, drops)
+			if ok {
+				drops.outbound.send(len(b))
+				f.capture.sent(conn, m.to, b)
+			}
+			return b, ok
+		}
+		wrote := func(m response, err error) {
+			if err != nil && retries.retry(m, err) {
+				return
 			}
-			var b bytes.Buffer
-			enc := gob.NewEncoder(&b)
-			err := enc.Encode(&m.m)
 			if err != nil {
-				log.Fatal("encode:", err)
+				drops.writeError.Add(1)
+			}
+			m.written(err)
+		}
+		if batch <= 1 || !writeBatches(conn, batch, window, clock, out,
+			encode, wrote, f.logger) {
+			for m := range out {
+				b, ok := encode(m)
+				if ok {
+					_, err := conn.WriteToUDP(b, m.to)
+					wrote(m, err)
+				}
 			}
-			conn.WriteToUDP(b.Bytes(), m.to)
 		}
-		log.Println("writer shutting down, sending 'done'-signal, closing 'done'-channel")
+		f.logDebug("writer shutting down, sending 'done'-signal, closing 'done'-channel")
 		done <- struct{}{}
 		close(done)
 	}()
 	return done
 }
 
-func watcher(seen chan *net.UDPAddr) chan *net.UDPAddr {
+// Spreads responses over bounded per-destination queues and hands them to
+// the writer round-robin, so a backlog for one destination neither stalls
+// the sender nor delays the others. A full queue drops its oldest response.
+func fairQueue(in chan response, capacity int, drops *dropCounters,
+	l logger) chan response {
+	out := make(chan response)
+	drops.queues.responses.depth = func() int { return len(in) }
+	go func() {
+		defer live()()
+		queues := make(map[address][]response)
+		order := make([]address, 0)
+		for in != nil || len(order) > 0 {
+			var next response
+			var send chan response
+			if len(order) > 0 {
+				next = queues[order[0]][0]
+				send = out
+			}
+			select {
+			case r, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				drops.queues.responses.observe(len(in) + 1)
+				if r.to == nil {
+					r.written(ErrDropped)
+					continue
+				}
+				a := addrKey(r.to)
+				q, ok := queues[a]
+				if !ok {
+					order = append(order, a)
+				}
+				q, dropped := enqueue(q, r, capacity)
+				if dropped != nil {
+					l.logWarn("send queue to", r.to, "full, dropping",
+						messageName(dropped.m))
+					drops.queueFull.Add(1)
+					dropped.written(ErrDropped)
+				}
+				queues[a] = q
+			case send <- next:
+				a := order[0]
+				order = order[1:]
+				q := queues[a][1:]
+				if len(q) == 0 {
+					delete(queues, a)
+				} else {
+					queues[a] = q
+					order = append(order, a)
+				}
+			}
+		}
+		l.logDebug("fairQueue shutting down, closing 'out'-channel")
+		close(out)
+	}()
+	return out
+}
+
+// Reports addresses not seen again within after.
+func watcher(clock Clock, seen chan *net.UDPAddr, after time.Duration,
+	l logger) chan *net.UDPAddr {
 	timeout := make(chan *net.UDPAddr)
 	go func() {
+		defer live()()
 		peers := make(map[address]chan struct{})
 		timeoutInner := make(chan *net.UDPAddr)
-		for seen != nil || len(peers) > 0 {
+		quit := make(chan struct{})
+		var drain <-chan time.Time
+		// Timeouts not yet taken. Reporting them must not keep the watcher
+		// from taking seen addresses, as their sender may be the one
+		// taking the timeouts.
+		pending := make([]*net.UDPAddr, 0)
+	loop:
+		for seen != nil || len(peers) > 0 || len(pending) > 0 {
+			var report chan *net.UDPAddr
+			var next *net.UDPAddr
+			if len(pending) > 0 {
+				report = timeout
+				next = pending[0]
+			}
 			select {
 			case m, ok := <-seen:
 				if !ok {
 					seen = nil
-					log.Println("'seen'-channel closed. Await all timeouts")
+					drain = clock.After(drainTimeout)
+					l.logDebug("'seen'-channel closed. Await all timeouts")
 					continue
 				}
+				pending = slices.DeleteFunc(pending, func(a *net.UDPAddr) bool {
+					return addrKey(a) == addrKey(m)
+				})
 				feed, ok := peers[addrKey(m)]
 				if !ok {
-					feed = watchdog(m, timeoutInner)
+					feed = watchdog(clock, m, after, timeoutInner, quit, l)
 					peers[addrKey(m)] = feed
 				}
 				feed <- struct{}{}
 			case a := <-timeoutInner:
-				log.Println("watcher timeout", a)
+				l.logDebug("watcher timeout", a)
 				delete(peers, addrKey(a))
-				timeout <- a
+				pending = append(pending, a)
+			case report <- next:
+				pending = pending[1:]
+			case <-drain:
+				for a, _ := range peers {
+					l.logDebug("drain timeout, abandoning watchdog", addrFromKey(a))
+				}
+				break loop
 			}
 		}
-		log.Println("watcher shutting down, closing 'timeout'-channel")
-		close(timeoutInner)
+		l.logDebug("watcher shutting down, closing 'timeout'-channel")
+		close(quit)
 		close(timeout)
 	}()
 	return timeout
@@ -139,83 +469,622 @@ func watcher(seen chan *net.UDPAddr) chan *net.UDPAddr {
 /******************************************************************************/
 
 type server struct {
-	peers map[address]struct{}
+	logger
+	config    ServerConfig
+	peers     map[address]struct{}
+	observers map[address]struct{}
+	cursors   map[address]int
+	lastSeen  map[address]time.Time
+	// Tracked peers from least to most recently seen, see track.
+	byRecency *list.List
+	recency   map[address]*list.Element
+	// Random, tags relayed data, see looped.
+	id uint64
+	// Session nonces of peers, see getPeerList.
+	sessions map[address]uint64
+	// Nil with a single socket, see ServerConfig.Addresses.
+	sockets *serverSockets
+	// Advertised private addresses, see PeerConfig.LocalPaths.
+	privates  map[address]address
+	publics   map[address][]byte
+	caps      map[address]capabilities
+	groups    map[address]string
+	names     map[address]string
+	tokens    map[relayToken]relayGrant
+	grants    map[relayGrant]relayToken
+	seen      chan *net.UDPAddr
+	responses chan response
+	drops     *dropCounters
+	// Sources that echoed their cookie, and what the others may still be
+	// sent, see ServerConfig.AmplificationLimit.
+	secret    [16]byte
+	validated map[address]struct{}
+	credit    map[address]credit
+	// Credited sources from least to most recently credited.
+	credited *list.List
+	// Whether the reader still delivers requests.
+	reading bool
+	stats   Stats
+}
+
+// Only sources tracked after handling their request are watched, so that
+// spoofed sources beyond MaxTrackedPeers cost no watchdog.
+func (s *server) process(request serverMessage) {
+	a := addrKey(request.from)
+	if s.config.RelayOnly {
+		s.trackTraffic(request.from)
+	}
+	if _, ok := s.peers[a]; ok {
+		s.seenNow(a)
+	}
+	s.stats.Messages[messageName(request.m)] += 1
+	if s.validate(a, false) {
+		request.m.updateServer(s, request.from, s.responses)
+	} else {
+		s.processLimited(request)
+	}
+	if _, ok := s.peers[a]; ok {
+		s.seen <- request.from
+	}
+}
+
+// Adds a to the tracked peers, evicting the least recently seen one if
+// MaxTrackedPeers is reached.
+func (s *server) track(a address) {
+	_, ok := s.peers[a]
+	max := s.config.MaxTrackedPeers
+	if !ok && max > 0 && len(s.peers) >= max {
+		oldest := s.byRecency.Front().Value.(address)
+		s.logInfo("evicting", addrFromKey(oldest))
+		s.forget(oldest)
+		s.stats.Evicted += 1
+	}
+	s.peers[a] = struct{}{}
+	s.seenNow(a)
+}
+
+func (s *server) seenNow(a address) {
+	s.lastSeen[a] = s.config.Clock.Now()
+	if e, ok := s.recency[a]; ok {
+		s.byRecency.MoveToBack(e)
+	} else {
+		s.recency[a] = s.byRecency.PushBack(a)
+	}
+}
+
+// Registers senders of any message, see ServerConfig.RelayOnly.
+func (s *server) trackTraffic(from *net.UDPAddr) {
+	a := addrKey(from)
+	if _, ok := s.peers[a]; ok {
+		return
+	}
+	if s.config.OnRegister != nil && !s.config.OnRegister(unmapped(from)) {
+		return
+	}
+	s.track(a)
+}
+
+// Whether from may use the relay, i.e. it polled the peer list recently.
+func (s *server) registered(from *net.UDPAddr) bool {
+	if _, ok := s.peers[addrKey(from)]; ok {
+		return true
+	}
+	s.logWarn("refusing to relay for unregistered", from)
+	s.stats.UnregisteredRelays += 1
+	s.drops.unregistered.Add(1)
+	if s.config.OnUnregisteredRelay != nil {
+		s.config.OnUnregisteredRelay(unmapped(from))
+	}
+	return false
+}
+
+func (s *server) forget(a address) {
+	delete(s.peers, a)
+	delete(s.observers, a)
+	delete(s.cursors, a)
+	delete(s.lastSeen, a)
+	if e, ok := s.recency[a]; ok {
+		s.byRecency.Remove(e)
+		delete(s.recency, a)
+	}
+	delete(s.privates, a)
+	delete(s.publics, a)
+	delete(s.caps, a)
+	delete(s.groups, a)
+	delete(s.names, a)
+	delete(s.sessions, a)
+	delete(s.validated, a)
+	s.forgetCredit(a)
+	s.sockets.forget(a)
+	s.revokeTokens(a)
+}
+
+// Opaque handle a peer relays to instead of a bare address.
+type relayToken [16]byte
+
+// Tokens are issued per pair, so a token is only honoured from the peer it
+// was issued to.
+type relayGrant struct {
+	from address
+	to   address
+}
+
+func (s *server) issueToken(g relayGrant) relayToken {
+	t, ok := s.grants[g]
+	if ok {
+		return t
+	}
+	_, err := rand.Read(t[:])
+	if err != nil {
+		log.Fatal("relay token:", err)
+	}
+	s.tokens[t] = g
+	s.grants[g] = t
+	return t
+}
+
+func (s *server) revokeTokens(a address) {
+	for t, g := range s.tokens {
+		if g.from == a || g.to == a {
+			delete(s.tokens, t)
+			delete(s.grants, g)
+		}
+	}
 }
 
 type serverRequest interface {
 	updateServer(s *server, from *net.UDPAddr, replies chan response)
 }
 
-type getPeerList struct{}
+type getPeerList struct {
+	Observer bool
+	// Ask for relayTokens along with the peerList.
+	RelayTokens bool
+	// Handed to peers behind the same NAT, zero for none.
+	Private address
+	Version int
+	// Handed to all peers, see PeerConfig.EndToEnd.
+	Public []byte
+	// Random per run of the peer, so the server notices a restart on the
+	// same address. Zero for peers predating it.
+	Session uint64
+	// Handed to all peers, see capabilities.
+	Capabilities capabilities
+	// Handed to all peers, see PeerConfig.Group.
+	Group string
+	// Handed to all peers, see PeerConfig.Name.
+	Name string
+	// Echoes peerList.Cookie, see ServerConfig.AmplificationLimit.
+	Cookie uint64
+	// Cookie is the one of the sender, as checked by a decoder.
+	echoed bool
+}
 
 func (m getPeerList) updateServer(s *server, from *net.UDPAddr,
 	replies chan response) {
-	log.Println("getPeerList from", from)
+	s.logDebug("getPeerList from", from)
+	if !s.versionOK(from, m.Version) {
+		return
+	}
+	if !s.validate(addrKey(from), m.echoed) {
+		s.challenge(from, replies)
+		return
+	}
+	if s.config.RelayOnly {
+		// Still tells the peer the server is alive. Partial, so the peer
+		// keeps the peers it learned otherwise.
+		replies <- response{to: from, m: peerList{
+			Partial:  true,
+			Observed: addrKey(from),
+			Version:  ProtocolVersion,
+		}}
+		return
+	}
 	a := addrKey(from)
-	s.peers[a] = struct{}{}
-	reply := peerList{make([]address, 0)}
+	if s.config.OnRegister != nil && !s.config.OnRegister(unmapped(from)) {
+		s.logInfo("registration rejected", from)
+		s.forget(a)
+		return
+	}
+	if old, ok := s.sessions[a]; ok && m.Session != old {
+		s.logInfo("peer restarted", from, "resetting its state")
+		s.forget(a)
+	}
+	if m.Session != 0 {
+		s.sessions[a] = m.Session
+	}
+	s.track(a)
+	if m.Observer {
+		s.observers[a] = struct{}{}
+	} else {
+		delete(s.observers, a)
+	}
+	if m.Private != (address{}) {
+		s.privates[a] = m.Private
+	} else {
+		delete(s.privates, a)
+	}
+	if m.Public != nil {
+		s.publics[a] = m.Public
+	} else {
+		delete(s.publics, a)
+	}
+	s.caps[a] = m.Capabilities
+	if m.Group != "" {
+		s.groups[a] = m.Group
+	} else {
+		delete(s.groups, a)
+	}
+	if m.Name != "" {
+		s.names[a] = m.Name
+	} else {
+		delete(s.names, a)
+	}
+	others := make([]address, 0, len(s.peers))
 	for k, _ := range s.peers {
 		if k != a {
-			reply.Addresses = append(reply.Addresses, k)
+			others = append(others, k)
+		}
+	}
+	reply := peerList{
+		Addresses: others,
+		Observers: make([]address, 0),
+		Total:     len(s.peers),
+		Version:   ProtocolVersion,
+		Observed:  a,
+	}
+	max := s.config.MaxPeersReturned
+	if max > 0 && len(others) > max {
+		// Hand out the sorted set page by page, so that every peer sees all
+		// others over consecutive polls.
+		slices.SortFunc(others, func(x, y address) int {
+			return bytes.Compare(x[:], y[:])
+		})
+		start := s.cursors[a]
+		if start >= len(others) {
+			start = 0
+		}
+		end := start + max
+		if end >= len(others) {
+			end = len(others)
+			reply.CycleEnd = true
+		}
+		s.cursors[a] = end
+		reply.Addresses = others[start:end]
+		reply.Partial = true
+	}
+	for _, k := range reply.Addresses {
+		if _, ok := s.observers[k]; ok {
+			reply.Observers = append(reply.Observers, k)
+		}
+	}
+	for i, k := range reply.Addresses {
+		private, ok := s.privates[k]
+		if !ok || !sameNAT(a, k) {
+			continue
+		}
+		if reply.Private == nil {
+			reply.Private = make([]address, len(reply.Addresses))
+		}
+		reply.Private[i] = private
+	}
+	for i, k := range reply.Addresses {
+		public, ok := s.publics[k]
+		if !ok {
+			continue
+		}
+		if reply.Public == nil {
+			reply.Public = make([][]byte, len(reply.Addresses))
+		}
+		reply.Public[i] = public
+	}
+	for i, k := range reply.Addresses {
+		if s.caps[k] == 0 {
+			continue
+		}
+		if reply.Capabilities == nil {
+			reply.Capabilities = make([]capabilities, len(reply.Addresses))
+		}
+		reply.Capabilities[i] = s.caps[k]
+	}
+	for i, k := range reply.Addresses {
+		group, ok := s.groups[k]
+		if !ok {
+			continue
 		}
+		if reply.Groups == nil {
+			reply.Groups = make([]string, len(reply.Addresses))
+		}
+		reply.Groups[i] = group
+	}
+	for i, k := range reply.Addresses {
+		name, ok := s.names[k]
+		if !ok {
+			continue
+		}
+		if reply.Names == nil {
+			reply.Names = make([]string, len(reply.Addresses))
+		}
+		reply.Names[i] = name
+	}
+	replies <- response{to: from, m: reply}
+	if m.RelayTokens {
+		tokens := relayTokens{
+			make([]address, 0, len(reply.Addresses)),
+			make([]relayToken, 0, len(reply.Addresses)),
+		}
+		for _, k := range reply.Addresses {
+			tokens.Addresses = append(tokens.Addresses, k)
+			tokens.Tokens = append(tokens.Tokens, s.issueToken(relayGrant{a, k}))
+		}
+		replies <- response{to: from, m: tokens}
 	}
-	replies <- response{from, reply}
 }
 
 type dataRelayTo struct {
-	To   address
-	Data []byte
+	To    address
+	Data  []byte
+	Codec string
+	Seq   uint64
+	// Non-zero for parity over that many datagrams up to Seq, see
+	// PeerConfig.FECGroup.
+	Parity int
+	// Random id of the sending peer, to recognize its own data.
+	Origin uint64
+	// Asks the receiver to acknowledge Seq, see PeerHandle.BroadcastAcked.
+	Ack bool
+	// Logical stream of the data, see SendOptions.Stream.
+	Stream uint16
+	// Ids of the servers that relayed the data, to break loops.
+	Via []uint64
 }
 
 func (m dataRelayTo) updateServer(s *server, from *net.UDPAddr,
 	replies chan response) {
 	toUDP := addrFromKey(m.To)
-	log.Println("dataRelayTo from", from, "to", toUDP)
-	_, ok := s.peers[m.To]
+	s.logDebug("dataRelayTo from", from, "to", toUDP)
+	if !s.registered(from) || s.looped(from, m.Stream, m.Via) {
+		return
+	}
+	to, ok := s.relayTarget(from, m.To, m.Data)
+	if !ok {
+		return
+	}
+	_, ok = s.peers[to]
+	if ok {
+		reply := dataRelayedFrom{
+			From:   addrKey(from),
+			Data:   m.Data,
+			Codec:  m.Codec,
+			Seq:    m.Seq,
+			Parity: m.Parity,
+			Origin: m.Origin,
+			Ack:    m.Ack,
+			Stream: m.Stream,
+			Via:    s.via(m.Stream, m.Via),
+		}
+		replies <- response{to: addrFromKey(to), m: reply}
+	}
+}
+
+// Where to relay data from from to to, see ServerConfig.RelayRouter.
+func (s *server) relayTarget(from *net.UDPAddr, to address,
+	data []byte) (address, bool) {
+	if s.config.RelayRouter == nil {
+		return to, true
+	}
+	target, ok := s.config.RelayRouter(unmapped(from),
+		unmapped(addrFromKey(to)), data)
+	if !ok {
+		s.drops.filtered.Add(1)
+		return to, false
+	}
+	return addrKey(net.UDPAddrFromAddrPort(target)), true
+}
+
+type dataRelayToken struct {
+	Token relayToken
+	Data  []byte
+	Codec string
+	Seq   uint64
+	// Non-zero for parity over that many datagrams up to Seq, see
+	// PeerConfig.FECGroup.
+	Parity int
+	// Random id of the sending peer, to recognize its own data.
+	Origin uint64
+	Ack    bool
+	Stream uint16
+	Via    []uint64
+}
+
+func (m dataRelayToken) updateServer(s *server, from *net.UDPAddr,
+	replies chan response) {
+	if !s.registered(from) || s.looped(from, m.Stream, m.Via) {
+		return
+	}
+	g, ok := s.tokens[m.Token]
+	if !ok || g.from != addrKey(from) {
+		s.logWarn("dataRelayToken with unknown token from", from)
+		return
+	}
+	to, ok := s.relayTarget(from, g.to, m.Data)
+	if !ok {
+		return
+	}
+	_, ok = s.peers[to]
 	if ok {
 		reply := dataRelayedFrom{
-			From: addrKey(from),
-			Data: m.Data,
+			From:   g.from,
+			Data:   m.Data,
+			Codec:  m.Codec,
+			Seq:    m.Seq,
+			Parity: m.Parity,
+			Origin: m.Origin,
+			Ack:    m.Ack,
+			Stream: m.Stream,
+			Via:    s.via(m.Stream, m.Via),
+		}
+		replies <- response{to: addrFromKey(to), m: reply}
+	}
+}
+
+// Application data for the server itself, see ServerConfig.OnServerData.
+type serverData struct {
+	Data []byte
+}
+
+// Dropped unless from a registered peer or a validated source, see
+// ServerConfig.AmplificationLimit, so that spoofed sources cannot inject it.
+func (m serverData) updateServer(s *server, from *net.UDPAddr,
+	replies chan response) {
+	a := addrKey(from)
+	_, registered := s.peers[a]
+	_, validated := s.validated[a]
+	if !registered && !validated {
+		s.logWarn("dropping server data from unregistered", from)
+		s.drops.unregistered.Add(1)
+		return
+	}
+	if s.config.OnServerData != nil {
+		s.config.OnServerData(unmapped(from), m.Data)
+	}
+}
+
+type serverMessage struct {
+	from *net.UDPAddr
+	m    serverRequest
+	// Of the datagram, see ServerConfig.AmplificationLimit.
+	size int
+}
+
+// Opens and decodes requests on workers goroutines. Requests from one
+// address go to the same worker, so they stay in order. Counts its
+// goroutines in running until they exited.
+func serverDecoders(requests chan request, workers int,
+	drops *dropCounters, f framing, secret [16]byte,
+	running *sync.WaitGroup) chan serverMessage {
+	decoded := make(chan serverMessage)
+	ins := make([]chan request, workers)
+	var wg sync.WaitGroup
+	running.Add(workers + 1)
+	for i := range ins {
+		ins[i] = make(chan request)
+		wg.Add(1)
+		go func(in chan request) {
+			defer running.Done()
+			defer live()()
+			defer wg.Done()
+			for request := range in {
+				buf, ok := f.sealing.unseal(request.buffer, request.from)
+				if !ok {
+					continue
+				}
+				var m serverRequest
+				err := decode(buf, &m)
+				if err != nil {
+					f.logDebug("ignoring", err, request)
+					drops.decodeError.Add(1)
+					continue
+				}
+				decoded <- serverMessage{request.from,
+					checkCookie(m, request.from, secret), len(buf)}
+			}
+		}(ins[i])
+	}
+	go func() {
+		defer running.Done()
+		defer live()()
+		for request := range requests {
+			drops.queues.requests.observe(len(requests) + 1)
+			h := fnv.New32a()
+			a := addrKey(request.from)
+			h.Write(a[:])
+			ins[h.Sum32()%uint32(workers)] <- request
+		}
+		for _, in := range ins {
+			close(in)
 		}
-		replies <- response{addrFromKey(m.To), reply}
+		wg.Wait()
+		f.logDebug("serverDecoders shutting down, closing 'decoded'-channel")
+		close(decoded)
+	}()
+	return decoded
+}
+
+// A server answering to responses and watching peers with seen.
+func newServer(config ServerConfig, seen chan *net.UDPAddr,
+	responses chan response, drops *dropCounters, sockets *serverSockets,
+	secret [16]byte) *server {
+	return &server{
+		logger:    logger{config.LogLevel},
+		config:    config,
+		seen:      seen,
+		responses: responses,
+		drops:     drops,
+		peers:     make(map[address]struct{}),
+		observers: make(map[address]struct{}),
+		cursors:   make(map[address]int),
+		lastSeen:  make(map[address]time.Time),
+		byRecency: list.New(),
+		recency:   make(map[address]*list.Element),
+		privates:  make(map[address]address),
+		publics:   make(map[address][]byte),
+		caps:      make(map[address]capabilities),
+		groups:    make(map[address]string),
+		names:     make(map[address]string),
+		id:        newOrigin(),
+		sessions:  make(map[address]uint64),
+		secret:    secret,
+		validated: make(map[address]struct{}),
+		credit:    make(map[address]credit),
+		credited:  list.New(),
+		tokens:    make(map[relayToken]relayGrant),
+		grants:    make(map[relayGrant]relayToken),
+		sockets:   sockets,
+		reading:   true,
+		stats:     newStats(),
 	}
 }
 
-func meshServer(requests chan request) chan response {
-	responses := make(chan response)
+func meshServer(config ServerConfig, requests chan serverMessage,
+	commands chan func(*server), stopped chan struct{},
+	drops *dropCounters, sockets *serverSockets,
+	secret [16]byte) chan response {
+	responses := make(chan response, channelCapacity)
 	go func() {
+		defer live()()
 		seen := make(chan *net.UDPAddr)
-		timeout := watcher(seen)
-		s := server{make(map[address]struct{})}
+		s := newServer(config, seen, responses, drops, sockets, secret)
+		timeout := watcher(config.Clock, seen, defaultPeerTimeout, s.logger)
+		var drain <-chan time.Time
 		for timeout != nil || requests != nil {
 			select {
+			case command := <-commands:
+				command(s)
+			case <-drain:
+				s.logDebug("drain timeout, abandoning the watcher")
+				timeout = nil
 			case a, ok := <-timeout:
 				if !ok {
 					timeout = nil
-					log.Println("'timeout'-channel closed")
+					s.logDebug("'timeout'-channel closed")
 					continue
 				}
-				delete(s.peers, addrKey(a))
+				s.forget(addrKey(a))
 			case request, ok := <-requests:
 				if !ok {
 					requests = nil
-					log.Println("'requests'-channel closed. Closing 'seen'-channel")
+					s.reading = false
+					drain = config.Clock.After(2 * drainTimeout)
+					s.logDebug("'requests'-channel closed. Closing 'seen'-channel")
 					close(seen)
 					continue
 				}
-				buf := bytes.NewBuffer(request.buffer)
-				dec := gob.NewDecoder(buf)
-				var m serverRequest
-				err := dec.Decode(&m)
-				if err != nil {
-					log.Println("ignoring", err, request)
-					continue
-				}
-				seen <- request.from
-				m.updateServer(&s, request.from, responses)
+				s.process(request)
 			}
 		}
-		log.Println("meshServer shutting down, closing 'responses'-channel")
+		s.logDebug("meshServer shutting down, closing 'responses'-channel")
+		close(stopped)
 		close(responses)
 	}()
 	return responses
@@ -226,10 +1095,129 @@ func meshServer(requests chan request) chan response {
 /******************************************************************************/
 
 type peer struct {
-	peerIds       map[address]int
-	nextPeerId    int
-	alivePeers    map[address]struct{}
+	logger
+	config    PeerConfig
+	localAddr netip.AddrPort
+	server    *net.UDPAddr
+	// Multicast group in discovery mode, and when each peer last announced
+	// itself there.
+	group      *net.UDPAddr
+	announced  map[address]time.Time
+	peerIds    map[address]uint64
+	nextPeerId uint64
+	alivePeers map[address]struct{}
+	observers  map[address]struct{}
+	// Peers answering keep-alives, yet to turn alive.
+	pendingAlive map[address]*aliveStreak
+	// Addresses and observers of the peer list pages since the last
+	// complete set.
+	listed          map[address]struct{}
+	listedObservers map[address]struct{}
+	mtu             map[address]*pathMTU
+	relayTokens     map[address]relayToken
+	// Compression negotiated per peer, see PeerConfig.Codecs.
+	codecs map[address]string
+	// Names advertised by the peers, see PeerConfig.Name.
+	names map[address]string
+	// Groups advertised by the peers, see PeerConfig.Group.
+	groups map[address]string
+	// See PeerHandle.ClockOffset.
+	skews map[address]clockSkew
+	// Features agreed on with each peer, see capabilities.
+	caps map[address]capabilities
+	// See PeerConfig.OnAsymmetricPath.
+	paths map[address]*pathDirections
+	// When each peer was last sent a keep-alive, see urgentKeepAlive.
+	lastPing map[address]time.Time
+	// Senders registered by AutoRegister, see mayReceive.
+	autoRegistered map[address]struct{}
+	// Whether the peer left the server, and since when it polls it, see
+	// PeerConfig.BootstrapPeers.
+	detached       bool
+	bootstrapSince time.Time
+	// RecvIndex of the last data handed over.
+	recvIndex uint64
+	// The last data handed over, a ring starting at recentNext once full.
+	recent     []PeerMsg
+	recentNext int
+	// Keys authenticating direct data to each peer. Those of data from
+	// them are in keys.
+	sendKeys map[address][]byte
+	// Last application send and keep-alive round, and the interval between
+	// keep-alive rounds while idle, 0 when not idle.
+	lastActive    time.Time
+	lastKeepAlive time.Time
+	idleInterval  time.Duration
+	// Peers registered with the server, as of the last peerList.
+	meshSize int
+	// When timed out peers turned stale, see PeerConfig.DeadAfter.
+	stale map[address]time.Time
+	// Last relay to peers that lost the direct path, see
+	// PeerConfig.MinRelayInterval.
+	lastRelay map[address]time.Time
+	// Broadcasts awaiting acknowledgements by sequence number, and their
+	// sequence numbers by peer and sequence number of the data to it.
+	broadcastSeq uint64
+	ackWindows   map[uint64]*ackWindow
+	ackSeqs      map[address]map[uint64]uint64
+	// Sequence number of the last own gossip, and when gossip was passed
+	// on, see PeerConfig.Fanout.
+	gossipSeq uint64
+	gossiped  map[gossipId]time.Time
+	// Private addresses of peers behind the same NAT, nil lan unless
+	// PeerConfig.LocalPaths.
+	privates map[address]address
+	lan      *lanRoutes
+	// Remembered reachability per peer, see probeDirect and direct.
+	directFailures  map[address]int
+	relayOnly       map[address]time.Time
+	confirmedDirect map[address]time.Time
+	// Peers last reported as reached directly, see checkRoute.
+	directRoutes map[address]struct{}
+	// Last sequence number sent to and reordering of data from each peer.
+	sendSeq  map[address]uint64
+	reorders map[address]*reorder
+	// Streams handed over if selecting, else all, see PeerHandle.Subscribe.
+	streams   map[uint16]struct{}
+	selecting bool
+	// Own key pair and public keys of peers, see PeerConfig.EndToEnd. The
+	// keys shared with them are in keys.
+	ecdh    *ecdh.PrivateKey
+	publics map[address][]byte
+	keys    *keyring
+	// Forward error correction state per peer.
+	fecSend map[address]*fecParity
+	fecRecv map[address]*fecReceived
+	// Addresses the peer itself is reachable on locally.
+	self          map[address]struct{}
 	seenPeerAlive chan *net.UDPAddr
+	responses     chan response
+	data          chan PeerMsg
+	drops         *dropCounters
+	// Whether the reader still delivers requests.
+	reading bool
+	// See PeerHandle.Events. Only filled once that was called.
+	events       chan PeerEvent
+	eventsWanted bool
+	// Tags the peer's data, see echo.
+	origin uint64
+	// Tells restarts apart, see getPeerList. Unlike origin never restored.
+	session uint64
+	// Whether the server answered recently, and whether it ever went
+	// silent after answering.
+	serverAlive bool
+	serverLost  bool
+	// The server and those to fail over to, see PeerConfig.FallbackServers.
+	servers []*net.UDPAddr
+	// Asks to resolve the servers again, see PeerConfig.ResolveInterval.
+	resolve chan struct{}
+	// When the peer started talking to the current server.
+	serverSince time.Time
+	// Where the server sees the peer, see observed.
+	publicAddr address
+	// Last handed out by the server, see getPeerList.Cookie.
+	cookie uint64
+	stats  Stats
 }
 
 type peerRequest interface {
@@ -237,142 +1225,1062 @@ type peerRequest interface {
 		data chan PeerMsg)
 }
 
-type peerList struct{ Addresses []address }
+type peerList struct {
+	Addresses []address
+	// Subset of Addresses that registered as observers.
+	Observers []address
+	// Addresses is one page of the peer set, see MaxPeersReturned.
+	Partial bool
+	// This page completes a pass over the peer set.
+	CycleEnd bool
+	// Private addresses of the listed peers behind the same NAT as the
+	// receiver, zero for the others. Nil if there are none.
+	Private []address
+	// Public keys of the listed peers, see PeerConfig.EndToEnd. Nil if
+	// there are none.
+	Public [][]byte
+	// Of the listed peers, see capabilities. Nil if there are none.
+	Capabilities []capabilities
+	// Of the listed peers, see PeerConfig.Group. Nil if none advertises
+	// one.
+	Groups []string
+	// Of the listed peers, see PeerConfig.Name. Nil if none advertises one.
+	Names []string
+	// Registered peers including the receiver, so a receiver alone with
+	// the server can tell.
+	Total   int
+	Version int
+	// The receiver's address as the server sees it.
+	Observed address
+	// For the receiver to echo in getPeerList, proving it receives at its
+	// address. Zero unless the server limits amplification.
+	Cookie uint64
+}
 
+// New addresses are added right away. Addresses are only dropped once a
+// complete set was seen, which takes several lists if they are Partial.
 func (m peerList) updatePeer(p *peer, from *net.UDPAddr, replies chan response,
 	data chan PeerMsg) {
-	knownPeerIds := make(map[address]int)
-	for _, a := range m.Addresses {
-		id, ok := p.peerIds[a]
+	if addrKey(from) != addrKey(p.server) {
+		p.logWarn("ignoring peerList from", from, "not the server")
+		return
+	}
+	if !p.versionOK(from, m.Version) {
+		return
+	}
+	p.serverSeen(from)
+	p.observed(m.Observed, replies)
+	if m.Cookie != 0 && m.Cookie != p.cookie {
+		// Registers right away rather than with the next tick.
+		p.cookie = m.Cookie
+		replies <- response{to: from, m: p.getPeerList()}
+	}
+	p.meshSize = m.Total
+	if p.config.OnPeerList != nil {
+		addrs := make([]netip.AddrPort, 0, len(m.Addresses))
+		for _, a := range m.Addresses {
+			if _, ok := p.self[a]; !ok {
+				addrs = append(addrs, unmapped(addrFromKey(a)))
+			}
+		}
+		p.config.OnPeerList(addrs)
+	}
+	for i, a := range m.Addresses {
+		if _, ok := p.self[a]; ok {
+			p.logDebug("ignoring own address in peer list", addrFromKey(a))
+			continue
+		}
+		p.listed[a] = struct{}{}
+		// Known before joining, for the join event.
+		if i < len(m.Names) {
+			p.names[a] = m.Names[i]
+		}
+		_, ok := p.peerIds[a]
 		if !ok {
-			id = p.nextPeerId
+			p.peerIds[a] = p.nextPeerId
 			p.nextPeerId += 1
+			p.joined(a)
+		}
+		if p.lan != nil && i < len(m.Private) &&
+			m.Private[i] != (address{}) {
+			p.privates[a] = m.Private[i]
+			p.lan.candidate(a, m.Private[i])
+		}
+		if i < len(m.Capabilities) {
+			p.learnCapabilities(a, m.Capabilities[i])
+		}
+		if i < len(m.Groups) {
+			p.groups[a] = m.Groups[i]
+		}
+		if i < len(m.Public) {
+			p.learnPublic(a, m.Public[i])
 		}
-		knownPeerIds[a] = id
 	}
-	p.peerIds = knownPeerIds
-}
-
-type keepAlive struct{}
-
-func (m keepAlive) updatePeer(p *peer, from *net.UDPAddr, replies chan response,
-	data chan PeerMsg) {
-	replies <- response{from, isAlive{}}
+	for _, a := range m.Observers {
+		p.listedObservers[a] = struct{}{}
+		p.observers[a] = struct{}{}
+	}
+	if m.Partial && !m.CycleEnd {
+		return
+	}
+	for a, _ := range p.peerIds {
+		_, ok := p.listed[a]
+		if ok {
+			continue
+		}
+		if _, alive := p.alivePeers[a]; !alive || p.config.DeadAfter <= 0 {
+			p.unlisted(a)
+		}
+	}
+	p.observers = p.listedObservers
+	p.listed = make(map[address]struct{})
+	p.listedObservers = make(map[address]struct{})
 }
 
-type isAlive struct{}
+// Sent by the server to peers it evicted, see ServerHandle.Evict.
+type kicked struct{}
 
-func (m isAlive) updatePeer(p *peer, from *net.UDPAddr, replies chan response,
-	data chan PeerMsg) {
-	p.alivePeers[addrKey(from)] = struct{}{}
-	p.seenPeerAlive <- from
+func (m kicked) updatePeer(p *peer, from *net.UDPAddr,
+	replies chan response, data chan PeerMsg) {
+	if addrKey(from) != addrKey(p.server) {
+		p.logWarn("ignoring kicked from", from, "not the server")
+		return
+	}
+	p.logWarn("kicked by the server")
+	if p.config.OnKicked != nil {
+		p.config.OnKicked()
+	}
 }
 
-type dataRelayedFrom struct {
-	From address
+// Administrative message of the server to all its peers, see
+// ServerHandle.Notify.
+type serverNotice struct {
 	Data []byte
 }
 
-func (m dataRelayedFrom) updatePeer(p *peer, from *net.UDPAddr,
+func (m serverNotice) updatePeer(p *peer, from *net.UDPAddr,
 	replies chan response, data chan PeerMsg) {
-	id, ok := p.peerIds[m.From]
-	if !ok {
-		log.Println("dataRelayedFrom unknown Peer, ignoring it", from)
-	} else {
-		data <- PeerMsg{id, m.Data}
+	if addrKey(from) != addrKey(p.server) {
+		p.logWarn("ignoring serverNotice from", from, "not the server")
+		return
+	}
+	if p.config.OnServerNotice != nil {
+		p.config.OnServerNotice(m.Data)
+	}
+}
+
+// Tokens to use in dataRelayToken instead of the paired addresses.
+type relayTokens struct {
+	Addresses []address
+	Tokens    []relayToken
+}
+
+func (m relayTokens) updatePeer(p *peer, from *net.UDPAddr,
+	replies chan response, data chan PeerMsg) {
+	for i, a := range m.Addresses {
+		if i < len(m.Tokens) {
+			p.relayTokens[a] = m.Tokens[i]
+		}
+	}
+}
+
+// Codecs advertises the compression codecs the sender supports.
+type keepAlive struct {
+	Codecs []string
+	Name   string
+	// For the receiver to authenticate its direct data with. In
+	// cleartext, see PeerConfig.AuthDirect.
+	Key     []byte
+	Version int
+	// X25519 public key, see PeerConfig.EndToEnd.
+	Public []byte
+	Group  string
+	// When sent, in Unix nanoseconds by the sender's clock, see
+	// PeerHandle.ClockOffset.
+	Sent int64
+	// See capabilities.
+	Capabilities capabilities
+}
+
+func (p *peer) keepAliveFor(a address) keepAlive {
+	return keepAlive{p.config.Codecs, p.config.Name, p.receiveKey(a),
+		ProtocolVersion, p.publicKey(), p.config.Group, p.timestamp(),
+		supportedCapabilities}
+}
+
+func (m keepAlive) updatePeer(p *peer, from *net.UDPAddr, replies chan response,
+	data chan PeerMsg) {
+	if !p.versionOK(from, m.Version) {
+		return
+	}
+	p.codecs[addrKey(from)] = negotiateCodec(p.config.Codecs, m.Codecs)
+	p.names[addrKey(from)] = m.Name
+	p.groups[addrKey(from)] = m.Group
+	p.sendKeys[addrKey(from)] = m.Key
+	p.learnCapabilities(addrKey(from), m.Capabilities)
+	p.learnPublic(addrKey(from), m.Public)
+	// Inbound works, so try outbound again.
+	delete(p.relayOnly, addrKey(from))
+	p.heardFrom(addrKey(from))
+	now := p.timestamp()
+	replies <- response{
+		to: from,
+		m: isAlive{p.config.Codecs, p.config.Name,
+			p.receiveKey(addrKey(from)), ProtocolVersion, p.publicKey(),
+			p.config.Group, m.Sent, now, now, supportedCapabilities},
+	}
+}
+
+type isAlive struct {
+	Codecs  []string
+	Name    string
+	Key     []byte
+	Version int
+	Public  []byte
+	Group   string
+	// The keep-alive's Sent, and when it was received and answered, by the
+	// sender's clock.
+	Echo     int64
+	Received int64
+	Sent     int64
+	// See capabilities.
+	Capabilities capabilities
+}
+
+func (m isAlive) updatePeer(p *peer, from *net.UDPAddr, replies chan response,
+	data chan PeerMsg) {
+	if !p.versionOK(from, m.Version) {
+		return
+	}
+	p.codecs[addrKey(from)] = negotiateCodec(p.config.Codecs, m.Codecs)
+	p.names[addrKey(from)] = m.Name
+	p.groups[addrKey(from)] = m.Group
+	p.sendKeys[addrKey(from)] = m.Key
+	p.learnCapabilities(addrKey(from), m.Capabilities)
+	p.learnPublic(addrKey(from), m.Public)
+	p.measureSkew(addrKey(from), m)
+	p.answeredBy(addrKey(from))
+	if !p.confirmAlive(addrKey(from)) {
+		p.seenPeerAlive <- from
+		return
+	}
+	p.alivePeers[addrKey(from)] = struct{}{}
+	p.confirmDirect(addrKey(from))
+	p.checkRoute(addrKey(from))
+	p.revived(addrKey(from))
+	p.seenPeerAlive <- from
+}
+
+// Compresses data with the codec negotiated with a, if any.
+func (p *peer) encodeData(a address, buf []byte) ([]byte, string) {
+	codec := p.codecs[a]
+	if codec == "" || !p.supports(a, capCompression) {
+		return buf, ""
+	}
+	compressed, err := compress(codec, buf)
+	if err != nil {
+		p.logWarn("cannot compress with", codec, "sending uncompressed:", err)
+		return buf, ""
+	}
+	return compressed, codec
+}
+
+func (p *peer) decodeData(buf []byte, codec string) ([]byte, bool) {
+	plain, err := unpack(buf, codec)
+	if err != nil {
+		p.logWarn("ignoring", codec, "data:", err)
+		return nil, false
+	}
+	return plain, true
+}
+
+// Strips the padding of buf and decompresses it.
+func unpack(buf []byte, codec string) ([]byte, error) {
+	buf, codec, err := unpad(buf, codec)
+	if err != nil {
+		return nil, fmt.Errorf("cannot strip padding: %w", err)
+	}
+	if codec == "" {
+		return buf, nil
+	}
+	plain, err := decompress(codec, buf)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress: %w", err)
+	}
+	return plain, nil
+}
+
+type dataRelayedFrom struct {
+	From  address
+	Data  []byte
+	Codec string
+	Seq   uint64
+	// Non-zero for parity over that many datagrams up to Seq, see
+	// PeerConfig.FECGroup.
+	Parity int
+	// Random id of the sending peer, to recognize its own data.
+	Origin uint64
+	Ack    bool
+	Stream uint16
+	Via    []uint64
+	pre    prepared
+}
+
+func (m dataRelayedFrom) updatePeer(p *peer, from *net.UDPAddr,
+	replies chan response, data chan PeerMsg) {
+	if p.echo(m.Origin) {
+		return
+	}
+	// Only the server vouches for the sender.
+	vouched := addrKey(from) == addrKey(p.server)
+	if !p.mayReceive(m.From, vouched) {
+		p.logDebug("dataRelayedFrom unknown Peer, ignoring it", from)
+	} else if buf, ok := p.openData(m.From, m.Data, m.Codec, m.pre); ok {
+		id := p.senderId(m.From)
+		if m.Ack {
+			p.ack(m.From, m.Seq, replies)
+		}
+		msg := PeerMsg{PeerId: id, Buf: buf, Stream: m.Stream, via: m.Via}
+		p.receive(m.From, m.Seq, m.Parity, msg, data)
 	}
 }
 
 type dataDirect struct {
-	Data []byte
+	Data  []byte
+	Codec string
+	Seq   uint64
+	// Non-zero for parity over that many datagrams up to Seq, see
+	// PeerConfig.FECGroup.
+	Parity int
+	// Random id of the sending peer, to recognize its own data.
+	Origin uint64
+	// Authenticates the data, see PeerConfig.AuthDirect.
+	MAC    []byte
+	Ack    bool
+	Stream uint16
+	pre    prepared
 }
 
 func (m dataDirect) updatePeer(p *peer, from *net.UDPAddr,
 	replies chan response, data chan PeerMsg) {
-	log.Println("dataDirect from", from)
+	p.logDebug("dataDirect from", from)
+	if p.echo(m.Origin) || !p.verify(from, m) {
+		return
+	}
 	a := addrKey(from)
+	// Only a MAC with the key handed out to a proves the sender receives
+	// at a.
+	if !p.mayReceive(a, p.config.AuthDirect) {
+		p.logDebug("dataDirect from unknown Peer, ignoring it", from)
+	} else if buf, ok := p.openData(a, m.Data, m.Codec, m.pre); ok {
+		id := p.senderId(a)
+		if m.Ack {
+			replies <- response{to: from, m: dataAck{m.Seq}}
+		}
+		msg := PeerMsg{PeerId: id, Buf: buf, Stream: m.Stream}
+		p.receive(a, m.Seq, m.Parity, msg, data)
+	}
+}
+
+// Smallest datagram every path is assumed to carry.
+const minDatagram = 508
+
+// Largest payload of a UDP datagram.
+const maxDatagram = 65507
+
+// Probing stops, once the search interval is this small.
+const mtuGranularity = 32
+
+// Binary search for the largest datagram a path to a peer carries. A probe
+// that was not acknowledged until the next one is due counts as lost.
+type pathMTU struct {
+	confirmed int
+	ceiling   int
+	pending   int
+}
+
+func newPathMTU(max int) *pathMTU {
+	return &pathMTU{minDatagram, max + 1, 0}
+}
+
+// Size of the next probe to send, 0 if the search is finished.
+func (t *pathMTU) nextProbe() int {
+	if t.pending != 0 {
+		t.ceiling = t.pending
+		t.pending = 0
+	}
+	if t.ceiling-t.confirmed <= mtuGranularity {
+		return 0
+	}
+	t.pending = (t.confirmed + t.ceiling) / 2
+	return t.pending
+}
+
+func (t *pathMTU) ack(size int) {
+	if size == t.pending {
+		t.pending = 0
+	}
+	if size > t.confirmed {
+		t.confirmed = size
+	}
+}
+
+func (t *pathMTU) converged() bool {
+	return t.ceiling-t.confirmed <= mtuGranularity
+}
+
+type mtuProbe struct {
+	Size    int
+	Padding []byte
+}
+
+// A probe padded to a datagram of size bytes, magic included. The encoding
+// is measured like encodedSize, as it grows with the padding.
+func newMTUProbe(size int, magic []byte) mtuProbe {
+	m := mtuProbe{Size: size}
+	for i := 0; i < 3; i++ {
+		overhead := len(magic) + encodedSize(m) - len(m.Padding)
+		m.Padding = make([]byte, max(size-overhead, 0))
+	}
+	return m
+}
+
+func (m mtuProbe) updatePeer(p *peer, from *net.UDPAddr, replies chan response,
+	data chan PeerMsg) {
+	replies <- response{to: from, m: mtuAck{m.Size}}
+}
+
+type mtuAck struct {
+	Size int
+}
+
+func (m mtuAck) updatePeer(p *peer, from *net.UDPAddr, replies chan response,
+	data chan PeerMsg) {
+	t, ok := p.mtu[addrKey(from)]
+	if ok {
+		t.ack(m.Size)
+	}
+}
+
+// The addresses a socket bound to local may receive on. For an unspecified
+// address these are all interface addresses with the bound port.
+func selfAddresses(local netip.AddrPort, l logger) map[address]struct{} {
+	self := make(map[address]struct{})
+	if !local.Addr().IsUnspecified() {
+		self[addrKey(net.UDPAddrFromAddrPort(local))] = struct{}{}
+		return self
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		l.logError("cannot list interface addresses:", err)
+		return self
+	}
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(n.IP)
+		if !ok {
+			continue
+		}
+		u := net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, local.Port()))
+		self[addrKey(u)] = struct{}{}
+	}
+	return self
+}
+
+// Called with every peer list. The server is considered unreachable once
+// the watcher times it out like any peer.
+func (p *peer) serverSeen(from *net.UDPAddr) {
+	if !p.serverAlive {
+		if p.serverLost {
+			p.stats.ServerReconnects += 1
+		}
+		p.serverAlive = true
+		p.stats.ServerConnectedSince = p.config.Clock.Now()
+	}
+	p.seenPeerAlive <- from
+}
+
+func newOrigin() uint64 {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		log.Fatal("origin:", err)
+	}
+	return max(binary.BigEndian.Uint64(b[:]), 1)
+}
+
+// Whether data of origin is the peer's own, echoed back to it, and to be
+// dropped.
+func (p *peer) echo(origin uint64) bool {
+	if origin != p.origin || p.config.DeliverEchoes {
+		return false
+	}
+	p.logDebug("dropping own data echoed back")
+	return true
+}
+
+func decodePeerRequest(buf []byte) (peerRequest, error) {
+	var m peerRequest
+	var err error
+	if isOpaque(buf) {
+		m, err = decodeOpaque(buf)
+	} else {
+		err = decode(buf, &m)
+	}
+	return m, err
+}
+
+func (p *peer) process(request peerMessage) {
+	p.stats.Messages[messageName(request.m)] += 1
+	request.m.updatePeer(p, request.from, p.responses, p.data)
+}
+
+func (p *peer) keepAlive(responses chan response) {
+	for addr, _ := range p.peerIds {
+		if !p.probeDirect(addr) {
+			continue
+		}
+		p.probedDirect(addr)
+		p.lastPing[addr] = p.config.Clock.Now()
+		p.logDebug("Sending keep alive")
+		responses <- response{
+			to: addrFromKey(addr),
+			m:  p.keepAliveFor(addr),
+		}
+		p.probeLocal(addr, responses)
+	}
+}
+
+// Asks the server for the peer list, or announces the peer to the
+// multicast group in discovery mode.
+func (p *peer) register(responses chan response) {
+	if p.group != nil {
+		responses <- response{to: p.group, m: announce{p.config.Name, p.config.Group}}
+		return
+	}
+	if p.detached {
+		return
+	}
+	responses <- response{to: p.server, m: p.getPeerList()}
+}
+
+// Reports a peer just assigned an id. Data from a peer is only handed over
+// once it has an id, so this precedes its first PeerMsg.
+func (p *peer) joined(a address) {
+	p.event(PeerJoined, a)
+	if p.config.OnPeerJoined != nil {
+		p.config.OnPeerJoined(p.peerIds[a], unmapped(addrFromKey(a)),
+			p.names[a])
+	}
+}
+
+// Most senders registered with PeerConfig.AutoRegister at a time.
+const maxAutoRegistered = 256
+
+// Whether data from a is handed over: a is known, or gets registered with
+// AutoRegister once its data opened. Only vouched for senders are.
+func (p *peer) mayReceive(a address, vouched bool) bool {
+	if _, ok := p.peerIds[a]; ok {
+		return true
+	}
+	_, self := p.self[a]
+	return p.config.AutoRegister && vouched && !self &&
+		len(p.autoRegistered) < maxAutoRegistered
+}
+
+// The id of the peer at a that sent data, registering it if unknown, see
+// mayReceive.
+func (p *peer) senderId(a address) uint64 {
 	id, ok := p.peerIds[a]
+	if ok {
+		return id
+	}
+	p.logInfo("registering unknown sender", addrFromKey(a))
+	id = p.nextPeerId
+	p.peerIds[a] = id
+	p.nextPeerId += 1
+	p.autoRegistered[a] = struct{}{}
+	p.joined(a)
+	return id
+}
+
+func (p *peer) forgetPeer(a address) {
+	if _, ok := p.peerIds[a]; ok {
+		p.event(PeerLeft, a)
+	}
+	if id, ok := p.peerIds[a]; ok && p.config.OnPeerLeft != nil {
+		p.config.OnPeerLeft(id)
+	}
+	delete(p.peerIds, a)
+	delete(p.relayTokens, a)
+	delete(p.codecs, a)
+	delete(p.names, a)
+	delete(p.groups, a)
+	delete(p.skews, a)
+	delete(p.caps, a)
+	delete(p.paths, a)
+	delete(p.lastPing, a)
+	delete(p.autoRegistered, a)
+	p.keys.forget(a)
+	delete(p.sendKeys, a)
+	delete(p.privates, a)
+	delete(p.stale, a)
+	delete(p.lastRelay, a)
+	delete(p.ackSeqs, a)
+	delete(p.publics, a)
+	if p.lan != nil {
+		p.lan.forget(a)
+	}
+	delete(p.directFailures, a)
+	delete(p.relayOnly, a)
+	delete(p.confirmedDirect, a)
+	delete(p.pendingAlive, a)
+	delete(p.directRoutes, a)
+	delete(p.sendSeq, a)
+	delete(p.reorders, a)
+	delete(p.fecSend, a)
+	delete(p.fecRecv, a)
+}
+
+// The request registering the peer with the server.
+func (p *peer) getPeerList() getPeerList {
+	return getPeerList{
+		Observer:     p.config.Observer,
+		RelayTokens:  p.config.RelayTokens,
+		Private:      p.privateAddress(),
+		Version:      ProtocolVersion,
+		Session:      p.session,
+		Public:       p.publicKey(),
+		Capabilities: supportedCapabilities,
+		Group:        p.config.Group,
+		Name:         p.config.Name,
+		Cookie:       p.cookie,
+	}
+}
+
+// Data the application asked to broadcast.
+type outgoing struct {
+	buf      []byte
+	deadline time.Time
+	// Send to the server as serverData instead of broadcasting.
+	toServer bool
+	future   *Future
+	// See SendOptions, ttl sets the deadline once taken by the peer.
+	ttl      time.Duration
+	route    Route
+	priority int
+	// Broadcast sequence number to acknowledge, see BroadcastAcked.
+	ack    uint64
+	stream uint16
+	// Only to peers advertising this group, see BroadcastToGroup.
+	group string
+	// The servers that relayed the data passed on, see looped.
+	via []uint64
+}
+
+func (p *peer) broadcast(o outgoing, responses chan response) error {
+	if p.config.Observer {
+		p.logDebug("observer does not broadcast, dropping data")
+		return ErrDropped
+	}
+	if len(p.peerIds) == 0 {
+		if p.config.OnBroadcastNoPeers != nil {
+			p.config.OnBroadcastNoPeers()
+		}
+		return ErrDropped
+	}
+	if p.gossips(o) {
+		return p.gossip(o, responses)
+	}
+	for addr, _ := range p.peerIds {
+		if p.broadcastsTo(addr, o) {
+			p.sendTo(addr, o, responses)
+		}
+	}
+	return nil
+}
+
+// Whether the broadcast o goes to the peer at addr.
+func (p *peer) broadcastsTo(addr address, o outgoing) bool {
+	if _, ok := p.observers[addr]; ok && p.config.SkipObservers {
+		return false
+	}
+	_, self := p.self[addr]
+	return !self && !p.isStale(addr) && p.inGroup(addr, o)
+}
+
+// Sends the data of o to the peer at addr, as part of a broadcast or not.
+func (p *peer) sendTo(addr address, o outgoing, responses chan response) {
+	p.checkRoute(addr)
+	send, direct := p.route(addr, o.route)
+	if !send {
+		if p.config.OnUnreachable != nil {
+			p.config.OnUnreachable(p.peerIds[addr])
+		}
+		return
+	}
+	if !direct && p.relayThrottled(addr) {
+		p.logWarn("relaying to", addrFromKey(addr), "too often, dropping")
+		p.drops.rateLimited.Add(1)
+		return
+	}
+	p.sendSeq[addr] += 1
+	seq := p.sendSeq[addr]
+	t, ok := p.mtu[addr]
+	if direct && ok && t.converged() && len(o.buf) > t.confirmed {
+		p.logWarn("broadcast of", len(o.buf), "bytes exceeds path MTU",
+			t.confirmed, "to", addrFromKey(addr))
+	}
+	p.sendData(addr, direct, o.buf, seq, 0, o, responses)
+	if p.config.FECGroup > 1 && p.supports(addr, capFEC) {
+		parity := p.addParity(addr, o.stream, o.buf)
+		if parity != nil {
+			p.sendData(addr, direct, parity, seq, p.config.FECGroup, o,
+				responses)
+		}
+	}
+}
+
+// Sends buf to addr, either directly or via the server.
+func (p *peer) sendData(addr address, direct bool, buf []byte, seq uint64,
+	parity int, o outgoing, responses chan response) {
+	cp := make([]byte, len(buf))
+	copy(cp, buf)
+	codec := ""
+	if !direct || !p.opaque(addr) {
+		cp, codec = p.encodeData(addr, cp)
+	}
+	cp, codec = p.pad(addr, cp, codec)
+	cp, codec, ok := p.seal(addr, cp, codec)
 	if !ok {
-		log.Println("dataDirect from unknown Peer, ignoring it", from)
+		if sent := o.track(); sent != nil {
+			sent(ErrDropped)
+		}
+		return
+	}
+	ack := o.ack != 0 && parity == 0 && p.supports(addr, capAcks)
+	if ack {
+		p.awaitAck(o.ack, addr, seq)
+	}
+	if direct {
+		responses <- response{
+			to: addrFromKey(addr),
+			m: p.directData(addr,
+				dataDirect{Data: cp, Codec: codec, Seq: seq, Parity: parity,
+					Origin: p.origin, Ack: ack, Stream: o.stream}),
+			deadline: o.deadline,
+			sent:     o.track(),
+			priority: o.priority,
+		}
+	} else if t, ok := p.relayTokens[addr]; ok {
+		m := dataRelayToken{t, cp, codec, seq, parity, p.origin, ack,
+			o.stream, o.via}
+		responses <- response{
+			to:       p.server,
+			m:        m,
+			deadline: o.deadline,
+			sent:     o.track(),
+			priority: o.priority,
+		}
 	} else {
-		data <- PeerMsg{id, m.Data}
+		m := dataRelayTo{addr, cp, codec, seq, parity, p.origin, ack,
+			o.stream, o.via}
+		responses <- response{
+			to:       p.server,
+			m:        m,
+			deadline: o.deadline,
+			sent:     o.track(),
+			priority: o.priority,
+		}
+	}
+}
+
+type peerMessage struct {
+	from *net.UDPAddr
+	m    peerRequest
+}
+
+// Decodes requests on workers goroutines like serverDecoders.
+func peerDecoders(requests chan request, workers int,
+	drops *dropCounters, f framing, keys *keyring,
+	running *sync.WaitGroup) chan peerMessage {
+	decoded := make(chan peerMessage)
+	ins := make([]chan request, workers)
+	var wg sync.WaitGroup
+	running.Add(workers + 1)
+	for i := range ins {
+		ins[i] = make(chan request)
+		wg.Add(1)
+		go func(in chan request) {
+			defer running.Done()
+			defer live()()
+			defer wg.Done()
+			for request := range in {
+				buf, ok := f.sealing.unseal(request.buffer, request.from)
+				if !ok {
+					continue
+				}
+				m, err := decodePeerRequest(buf)
+				if err != nil {
+					f.logDebug("ignoring", err, request)
+					drops.decodeError.Add(1)
+					continue
+				}
+				decoded <- peerMessage{request.from,
+					keys.prepare(m, request.from)}
+			}
+		}(ins[i])
+	}
+	go func() {
+		defer running.Done()
+		defer live()()
+		for request := range requests {
+			drops.queues.requests.observe(len(requests) + 1)
+			h := fnv.New32a()
+			a := addrKey(request.from)
+			h.Write(a[:])
+			ins[h.Sum32()%uint32(workers)] <- request
+		}
+		for _, in := range ins {
+			close(in)
+		}
+		wg.Wait()
+		f.logDebug("peerDecoders shutting down, closing 'decoded'-channel")
+		close(decoded)
+	}()
+	return decoded
+}
+
+// A peer in its initial state, for meshPeer to run.
+func newPeer(config PeerConfig, localAddr netip.AddrPort,
+	servers []*net.UDPAddr, group *net.UDPAddr, resolve chan struct{},
+	responses chan response, data chan PeerMsg, events chan PeerEvent,
+	drops *dropCounters, lan *lanRoutes, keys *keyring) *peer {
+	p := &peer{
+		logger:          logger{config.LogLevel},
+		config:          config,
+		localAddr:       localAddr,
+		servers:         servers,
+		resolve:         resolve,
+		group:           group,
+		announced:       make(map[address]time.Time),
+		peerIds:         make(map[address]uint64),
+		nextPeerId:      0,
+		alivePeers:      make(map[address]struct{}),
+		pendingAlive:    make(map[address]*aliveStreak),
+		observers:       make(map[address]struct{}),
+		listed:          make(map[address]struct{}),
+		listedObservers: make(map[address]struct{}),
+		mtu:             make(map[address]*pathMTU),
+		relayTokens:     make(map[address]relayToken),
+		codecs:          make(map[address]string),
+		names:           make(map[address]string),
+		groups:          make(map[address]string),
+		skews:           make(map[address]clockSkew),
+		caps:            make(map[address]capabilities),
+		paths:           make(map[address]*pathDirections),
+		lastPing:        make(map[address]time.Time),
+		autoRegistered:  make(map[address]struct{}),
+		sendKeys:        make(map[address][]byte),
+		directFailures:  make(map[address]int),
+		relayOnly:       make(map[address]time.Time),
+		confirmedDirect: make(map[address]time.Time),
+		directRoutes:    make(map[address]struct{}),
+		sendSeq:         make(map[address]uint64),
+		reorders:        make(map[address]*reorder),
+		fecSend:         make(map[address]*fecParity),
+		fecRecv:         make(map[address]*fecReceived),
+		self:            selfAddresses(localAddr, logger{config.LogLevel}),
+		seenPeerAlive:   make(chan *net.UDPAddr),
+		responses:       responses,
+		data:            data,
+		events:          events,
+		drops:           drops,
+		reading:         true,
+		origin:          newOrigin(),
+		session:         newOrigin(),
+		lastActive:      config.Clock.Now(),
+		bootstrapSince:  config.Clock.Now(),
+		privates:        make(map[address]address),
+		stale:           make(map[address]time.Time),
+		lastRelay:       make(map[address]time.Time),
+		ackWindows:      make(map[uint64]*ackWindow),
+		gossiped:        make(map[gossipId]time.Time),
+		streams:         make(map[uint16]struct{}),
+		ecdh:            newKeyPair(config.EndToEnd),
+		publics:         make(map[address][]byte),
+		keys:            keys,
+		ackSeqs:         make(map[address]map[uint64]uint64),
+		lan:             lan,
+		stats:           newStats(),
+	}
+	if len(servers) > 0 {
+		p.server = servers[0]
+		p.serverSince = config.Clock.Now()
 	}
+	return p
 }
 
-func meshPeer(serverAddressUdp *net.UDPAddr, requests chan request,
-	broadcast chan []byte) (chan PeerMsg, chan response) {
-	data := make(chan PeerMsg)
-	responses := make(chan response)
+func meshPeer(config PeerConfig, localAddr netip.AddrPort,
+	servers []*net.UDPAddr, group *net.UDPAddr,
+	requests chan peerMessage, broadcast chan []byte, sends chan outgoing,
+	ticker <-chan time.Time, rebound <-chan netip.AddrPort,
+	commands chan func(*peer), stopped chan struct{},
+	drops *dropCounters, lan *lanRoutes, resolve chan struct{},
+	events chan PeerEvent, keys *keyring) (chan PeerMsg, chan response) {
+	data := make(chan PeerMsg, channelCapacity)
+	responses := make(chan response, channelCapacity)
+	drops.queues.data.depth = func() int { return len(data) }
 	go func() {
-		p := peer{
-			make(map[address]int),
-			0,
-			make(map[address]struct{}),
-			make(chan *net.UDPAddr),
-		}
-		timeout := watcher(p.seenPeerAlive)
-		ticker := time.Tick(3 * time.Second)
+		defer live()()
+		p := newPeer(config, localAddr, servers, group, resolve, responses,
+			data, events, drops, lan, keys)
+		timeout := watcher(config.Clock, p.seenPeerAlive, config.PeerTimeout,
+			p.logger)
+		// Poll the peer list right away and often at first, to learn the
+		// peer set quickly.
+		var warmup, warmupEnd <-chan time.Time
+		if !config.ManualTick && config.WarmupPeriod > 0 {
+			p.register(responses)
+			warmup = config.Clock.Tick(config.WarmupInterval)
+			warmupEnd = config.Clock.After(config.WarmupPeriod)
+		}
+		var drain, urgent <-chan time.Time
 		for timeout != nil || requests != nil {
 			select {
+			case command := <-commands:
+				command(p)
+			case <-drain:
+				p.logDebug("drain timeout, abandoning the watcher")
+				timeout = nil
+			case <-urgent:
+				urgent = nil
+				p.urgentKeepAlive(responses)
+			case <-warmup:
+				p.register(responses)
+			case <-warmupEnd:
+				warmup = nil
+				warmupEnd = nil
+			case a := <-rebound:
+				old := p.localAddr
+				p.localAddr = a
+				p.self = selfAddresses(a, p.logger)
+				p.register(responses)
+				if p.config.OnRebind != nil {
+					p.config.OnRebind(old, a)
+				}
 			case <-ticker:
-				// TODO: timout on the peer list?
-				responses <- response{serverAddressUdp, getPeerList{}}
+				p.flushReorders(data)
+				p.expireReceived()
+				p.expireAnnounced()
+				p.expireStale()
+				p.expireAcks()
+				p.expireGossip()
+				p.checkAsymmetry()
+				p.checkBootstrap()
+				p.checkServer(responses)
 				for addr, _ := range p.peerIds {
-					log.Println("Sending keep alive")
-					responses <- response{addrFromKey(addr), keepAlive{}}
+					p.checkRoute(addr)
+				}
+				p.register(responses)
+				if p.keepAliveDue() {
+					p.keepAlive(responses)
+				}
+				if !config.ManualTick {
+					urgent = config.Clock.After(urgentDelay)
+				}
+				for addr, _ := range p.alivePeers {
+					t, ok := p.mtu[addr]
+					if !ok {
+						t = newPathMTU(p.config.MaxDatagram)
+						p.mtu[addr] = t
+					}
+					size := t.nextProbe()
+					if size != 0 {
+						responses <- response{
+							to: addrFromKey(addr),
+							m:  newMTUProbe(size, p.config.Magic),
+						}
+					}
 				}
 			case a, ok := <-timeout:
 				if !ok {
 					timeout = nil
-					log.Println("'timeout'-channel closed")
+					p.logDebug("'timeout'-channel closed")
+					continue
+				}
+				if addrKey(a) == addrKey(p.server) && p.detached {
+					p.serverAlive = false
+					p.stats.ServerConnectedSince = time.Time{}
 					continue
 				}
-				log.Println("Peer timed out", a)
+				if addrKey(a) == addrKey(p.server) {
+					p.logWarn("Server unreachable", a)
+					p.serverAlive = false
+					p.serverLost = true
+					p.stats.ServerConnectedSince = time.Time{}
+					p.reresolve()
+					p.failOver(responses)
+					continue
+				}
+				p.logInfo("Peer timed out", a)
+				if p.lan != nil {
+					p.lan.unroute(addrKey(a))
+				}
 				delete(p.alivePeers, addrKey(a))
+				delete(p.pendingAlive, addrKey(a))
+				delete(p.mtu, addrKey(a))
+				p.timedOut(addrKey(a))
+				p.checkRoute(addrKey(a))
 			case buf, ok := <-broadcast:
 				if !ok {
-					log.Println("broadcast channel was closed, only reading from now on")
+					p.logInfo("broadcast channel was closed, only reading from now on")
 					broadcast = nil
 					continue
 				}
-				for addr, _ := range p.peerIds {
-					cp := make([]byte, len(buf))
-					copy(cp, buf)
-					_, isAlive := p.alivePeers[addr]
-					if isAlive {
-						m := response{
-							addrFromKey(addr),
-							dataDirect{cp},
-						}
-						responses <- m
-					} else {
-						m := response{
-							serverAddressUdp,
-							dataRelayTo{addr, cp},
-						}
-						responses <- m
+				p.drops.queues.broadcast.observe(len(broadcast) + 1)
+				p.active(responses)
+				p.broadcast(outgoing{buf: buf}, responses)
+			case o := <-sends:
+				p.active(responses)
+				if o.ttl > 0 {
+					o.deadline = p.config.Clock.Now().Add(o.ttl)
+				}
+				if o.toServer && p.server == nil {
+					p.logDebug("no server in discovery mode, dropping data")
+					o.queued(ErrDropped)
+					continue
+				}
+				if o.toServer {
+					responses <- response{
+						to:       p.server,
+						m:        serverData{o.buf},
+						deadline: o.deadline,
+						sent:     o.track(),
 					}
+					o.queued(nil)
+					continue
 				}
+				o.queued(p.broadcast(o, responses))
 			case request, ok := <-requests:
 				if !ok {
 					requests = nil
-					log.Println("'requests'-channel closed. Closing 'p.seenPeerAlive'-channel")
+					p.reading = false
+					drain = config.Clock.After(2 * drainTimeout)
+					p.logDebug("'requests'-channel closed. Closing 'p.seenPeerAlive'-channel")
 					close(p.seenPeerAlive)
 					continue
 				}
-				buf := bytes.NewBuffer(request.buffer)
-				dec := gob.NewDecoder(buf)
-				var m peerRequest
-				err := dec.Decode(&m)
-				if err != nil {
-					log.Println("ignoring", err, request)
-					continue
-				}
-				m.updatePeer(&p, request.from, responses, data)
+				p.process(request)
 			}
 		}
-		log.Println("meshPeer shutting down, closing 'responses'-channel, closing 'data'-channel")
+		p.logDebug("meshPeer shutting down, closing 'responses'-channel, closing 'data'-channel")
+		close(stopped)
 		close(data)
+		close(events)
 		close(responses)
 	}()
 	return data, responses
@@ -383,78 +2291,1352 @@ func meshPeer(serverAddressUdp *net.UDPAddr, requests chan request,
 /******************************************************************************/
 
 type PeerMsg struct {
-	PeerId int
+	// Assigned by the receiving peer in the order it learns of peers,
+	// starting at zero. Ids are never reused: a peer that is forgotten and
+	// listed again gets a new one.
+	PeerId uint64
 	Buf    []byte
+	// Logical stream the sender sent the data on, see SendOptions.Stream.
+	Stream uint16
+	// Counts the data the peer handed over, starting at one, so data of
+	// all senders can be put in the order it was received.
+	RecvIndex uint64
+	// The servers that relayed the data, for passing it on, see looped.
+	via []uint64
+}
+
+// A known peer, see PeerHandle.Peers.
+type PeerInfo struct {
+	Id      uint64
+	Address netip.AddrPort
+	// Advertised by the peer, see PeerConfig.Name.
+	Name string
+	// Advertised by the peer, see PeerConfig.Group.
+	Group string
+	// Whether data goes to it directly rather than via the server.
+	Direct bool
+	// Timed out and not sent data, see PeerConfig.DeadAfter.
+	Stale bool
+	// Estimated from the last answered keep-alive, zero before that. See
+	// PeerHandle.ClockOffset.
+	ClockOffset time.Duration
+	RoundTrip   time.Duration
+}
+
+type PeerConfig struct {
+	// Local address to listen on. Missing parts are filled in, an empty
+	// address listens on an ephemeral port on all interfaces.
+	LocalAddress string
+	// Address of the server. A missing port defaults to 8981.
+	ServerAddress string
+	// Seals data end-to-end with a key per pair of peers, agreed on via
+	// X25519 from public keys exchanged with keep-alives and handed out by
+	// the server. The first key learned for a peer is kept until the peer
+	// is forgotten, later ones are ignored. Keys are not authenticated, so
+	// the server is trusted to hand out genuine ones, as is the network
+	// until first contact: the server relays sealed data it cannot read,
+	// unless it handed out keys of its own. Data to peers whose key is not
+	// known yet is dropped, and unsealed data is rejected, so all peers of
+	// a mesh must set it.
+	EndToEnd bool
+	// Sends all data handed over back to the peer it came from, as a
+	// reflector for latency measurements and testing other clients. Data is
+	// still handed over. Two echo peers echo each other forever, so a mesh
+	// should hold only one.
+	EchoPeer bool
+	// Pads the payload of data messages to this many bytes, so observers
+	// cannot tell their sizes apart, at the cost of sending that many bytes
+	// for every payload however small. Payloads of more than PadTo-4 bytes
+	// are sent unpadded. Lowered to leave room for the headers within
+	// MaxDatagram, which may disable it. Zero disables padding.
+	PadTo int
+	// Servers to fail over to in turn once the current one is unreachable,
+	// after which the peer registers with the next. Relays only reach peers
+	// registered with the same server, so all peers should list the same
+	// servers in the same order.
+	FallbackServers []string
+	// Without ServerAddress, looks up servers advertised via mDNS, see
+	// ServerConfig.MDNS, and takes the first to answer.
+	MDNS bool
+	// Used instead of listening on LocalAddress, if set.
+	Transport Transport
+	// "udp4" or "udp6" to resolve and listen on that family only, rather
+	// than letting the stack choose. Defaults to "udp".
+	Network string
+	// Goroutines decoding requests, so expensive decoding does not hold up
+	// keep-alives. They also authenticate, open and decompress data. Peer
+	// state stays with the single peer goroutine, while the order of the
+	// requests from each address is kept. Defaults to one.
+	Workers int
+	// Defaults to the system clock.
+	Clock Clock
+	// An observer receives broadcasts but never sends data. It registers as
+	// observer with the server, so other peers may skip sending to it.
+	Observer bool
+	// Do not send broadcasts to peers that registered as observers.
+	SkipObservers bool
+	// Send each broadcast to this many random peers only, which pass it on
+	// to as many others, until it spread through the mesh. Peers hand
+	// such data over once, as data of the broadcasting peer. As each peer
+	// passes a broadcast on once, about e^-Fanout of the peers miss it, so
+	// pick it well above the log of the mesh size. Zero sends broadcasts
+	// to every peer. Needs a server, and does not apply to BroadcastAcked.
+	// The origin of gossip is not verified, so it is off, and gossip
+	// received is dropped, with AuthDirect or EndToEnd.
+	Fanout int
+	// Relay through opaque tokens issued by the server instead of addressing
+	// the destination directly, once the server has issued them.
+	RelayTokens bool
+	// Never relay data through the server. Peers without a direct path do
+	// not receive broadcasts, the server is only used for discovery.
+	NoRelay bool
+	// Called from the peer goroutine for each peer a broadcast skipped,
+	// because it has no direct path and NoRelay is set, or the Route of the
+	// send rules out relaying. Must not block.
+	OnUnreachable func(peerId uint64)
+	// Largest datagram to send. Larger datagrams are dropped. The size a path
+	// to a peer actually carries is probed up to this value, but is only
+	// advisory: data exceeding it is logged, not dropped. Defaults to the
+	// largest UDP payload.
+	MaxDatagram int
+	// Do not refresh the peer list and send keep-alives every 3 seconds, but
+	// only when PeerHandle.Tick is called.
+	ManualTick bool
+	// After starting, the peer list is polled every WarmupInterval for
+	// WarmupPeriod, before settling to polling every 3 seconds. Default to
+	// 500ms and 3s, a negative WarmupPeriod disables the warmup.
+	WarmupInterval time.Duration
+	WarmupPeriod   time.Duration
+	// Compression codecs in order of preference, e.g. CodecFlate. Each peer
+	// uses the first one the other side supports as well. Peers advertising
+	// none exchange uncompressed data.
+	Codecs []string
+	// Data from one peer is numbered and may be held back to hand it over
+	// in the order it was sent, whether it came directly or via the server.
+	// Up to ReorderWindow datagrams wait for a missing one; once more
+	// arrive, or at the next tick, the gap is skipped and the late datagram
+	// dropped if it still shows up. Zero hands data over as it arrives.
+	// There is no ordering between different senders.
+	ReorderWindow int
+	// Hand over data the peer sent itself, should it ever be echoed back,
+	// e.g. via the server. Such data is dropped by default.
+	DeliverEchoes bool
+	// Called from the peer goroutine whenever data to a peer switches
+	// between going direct and via the server, e.g. to adapt to the
+	// latency. Must not block.
+	OnTransportChange func(peerId uint64, now Path)
+	// Called from the peer goroutine when the server evicted the peer. It
+	// registers again with the next poll, should the server accept that.
+	// Must not block.
+	OnKicked func()
+	// Called from the peer goroutine with notices the server sends all its
+	// peers, see ServerHandle.Notify. Must not block.
+	OnServerNotice func(data []byte)
+	// Drop direct data lacking authentication by the key handed to its
+	// sender with the keep-alives. The key travels in cleartext, so this
+	// keeps out blind spoofers only: whoever can watch the path learns the
+	// key and can forge data. EndToEnd also authenticates against them.
+	// Peers always authenticate what they send.
+	AuthDirect bool
+	// Called from the peer goroutine with the source of direct data failing
+	// authentication. Must not block.
+	OnAuthFailure func(from netip.AddrPort)
+	// Send direct data behind a fixed binary header with the payload
+	// verbatim, instead of gob encoded and compressed. Saves the per-message
+	// overhead of gob. Peers always accept such data, but those of older
+	// versions drop it.
+	Opaque bool
+	// Advertise a private address of the peer via the server to peers
+	// behind the same NAT, and keep alive theirs. Once a peer answers on
+	// its private address, direct data to it goes over the local network.
+	LocalPaths bool
+	// How many answers to keep-alives in a row it takes for a peer to turn
+	// alive, and data to it to go direct. Guards against a stray late
+	// answer flipping a dead path alive. Defaults to 1.
+	AliveConfirmations int
+	// After PeerTimeout without answers to keep-alives, a peer, or the
+	// server, times out. Defaults to 5 seconds.
+	PeerTimeout time.Duration
+	// Peers timing out turn stale for DeadAfter, instead of just losing the
+	// direct path. Stale peers keep their id, even when the server stops
+	// listing them, but get no data until they answer again. Then they are
+	// forgotten. Peers the server stops listing while their direct path is
+	// down are forgotten right away, unless stale. Zero disables this.
+	DeadAfter time.Duration
+	// Called from the peer goroutine with data about to be delivered.
+	// Returning false drops it, e.g. for a missing signature, before it
+	// wakes the application. Must not block.
+	Filter func(peerId uint64, data []byte) bool
+	// Relays data to a peer that lost its direct path at most once per
+	// MinRelayInterval, dropping the rest, to spare the server while the
+	// peer is likely gone. Peers never reached directly are relayed to as
+	// usual. Zero disables this.
+	MinRelayInterval time.Duration
+	// Called from the peer goroutine with the source and version of
+	// messages of another ProtocolVersion, which are ignored. Must not
+	// block.
+	OnVersionMismatch func(from netip.AddrPort, version int)
+	// Called from the peer goroutine as each peer acknowledges a broadcast
+	// of PeerHandle.BroadcastAcked, and once all did or AckTimeout passed,
+	// with how many of how many peers did. AckTimeout defaults to 5
+	// seconds and is checked every tick. Must not block.
+	OnDelivered         func(seq uint64, peerId uint64)
+	OnBroadcastComplete func(seq uint64, delivered, total int)
+	AckTimeout          time.Duration
+	// Without application sends for IdleAfter, keep-alives go out at
+	// doubling intervals up to MaxIdleInterval, instead of every tick. The
+	// next send snaps back. Peers may time out meanwhile, relaying data
+	// until the next keep-alive is answered. Zero IdleAfter disables this,
+	// MaxIdleInterval defaults to a minute.
+	IdleAfter       time.Duration
+	MaxIdleInterval time.Duration
+	// Forward error correction: after every FECGroup datagrams to a peer a
+	// parity datagram follows, from which the peer recovers any single one
+	// of them that got lost, without a resend. Costs 1/FECGroup more
+	// traffic. Zero or one disables it, at most 64. Receiving needs no
+	// configuration.
+	FECGroup int
+	// Datagrams read per system call on Linux, using recvmmsg. Zero or one
+	// reads them one by one. Not combinable with Rebind.
+	ReadBatch int
+	// Datagrams written per system call on Linux, using sendmmsg. Zero or
+	// one writes them one by one. A batch is sent once WriteBatchWindow
+	// passed or it is full, a zero window sends what is queued right away.
+	// Not combinable with Rebind.
+	WriteBatch       int
+	WriteBatchWindow time.Duration
+	// Differentiated services code point, 0 to 63, to mark all datagrams
+	// with, e.g. 46 for expedited forwarding. Zero leaves the marking to the
+	// system. Needs a *net.UDPConn, as opened without Transport.
+	DSCP int
+	// Prefix of every mesher datagram, to share the socket with other
+	// protocols. Either empty or 4 bytes long. Datagrams lacking it are
+	// passed to OnForeignPacket, or dropped if that is not set.
+	Magic []byte
+	// Called from the reader goroutine with every datagram lacking Magic.
+	// Must not block.
+	OnForeignPacket func(data []byte, from *net.UDPAddr)
+	// AES key of 16, 24 or 32 bytes shared by the server and its peers.
+	// All their traffic, control messages and relayed data alike, is then
+	// encrypted and authenticated. A server with a key only talks to peers
+	// with the same key.
+	ServerKey []byte
+	// Datagrams queued per destination before the oldest is dropped.
+	// Defaults to 64.
+	SendQueueSize int
+	// Bytes per second the peer sends at most, all datagrams counted,
+	// zero for no limit. Datagrams over budget wait, backing up the send
+	// queues, which then drop those of lowest priority first, see
+	// SendOptions.Priority. Stats.OutboundRate shows the rate sent.
+	MaxOutboundBps int
+	// Resolve the server addresses again this often, as well as whenever
+	// the server stops answering, so a peer follows a server whose DNS
+	// record moved. Zero only resolves them again on failure.
+	ResolveInterval time.Duration
+	// Writes failing for a momentarily full socket buffer are kept, up to
+	// this many, and attempted again shortly after, instead of dropped. A
+	// full buffer drops its oldest write. Zero disables this.
+	RetryBuffer int
+	// Keep copies of the last this many data handed to the application,
+	// for PeerHandle.RecentMessages to show. Zero disables this.
+	RecentMessages int
+	// Records every datagram sent and received in pcap format, with made
+	// up IP and UDP headers, for Wireshark to open. Writes are serialized.
+	PcapWriter io.Writer
+	// Replace the socket with a fresh one on an ephemeral port, once sending
+	// keeps failing, e.g. after resuming from sleep on another network. Only
+	// applies to sockets mesher opened itself.
+	Rebind bool
+	// Called from the peer goroutine after the socket was rebound. The peer
+	// re-registers with the server right away. Must not block.
+	OnRebind func(old, new netip.AddrPort)
+	// Called from the peer goroutine with the id of a peer whose
+	// keep-alives kept arriving for PeerTimeout, while it answered none of
+	// the peer's: its packets get through, but not those to it, e.g. due to
+	// its NAT. Called again only after it answered. Must not block.
+	OnAsymmetricPath func(peerId uint64)
+	// Called from the peer goroutine when the address the server sees the
+	// peer at changes, e.g. as the NAT mapped it anew. The direct paths are
+	// probed again right away. Must not block.
+	OnNATRebind func(old, new netip.AddrPort)
+	// Called from the peer goroutine with the addresses of other peers in
+	// every peer list received from the server. With MaxPeersReturned on
+	// the server these are pages of the peer set. Must not block.
+	OnPeerList func(addrs []netip.AddrPort)
+	// Called from the peer goroutine when a peer gets its id, before any
+	// PeerMsg from it is handed over, and when it is forgotten, after which
+	// none is. PeerMsgs already queued may still follow OnPeerLeft. The
+	// name is the one the peer advertises, if already known, see Name. Must
+	// not block.
+	OnPeerJoined func(peerId uint64, addr netip.AddrPort, name string)
+	OnPeerLeft   func(peerId uint64)
+	// Called from the peer goroutine whenever a broadcast is issued while no
+	// peers are known. The broadcast is dropped. Must not block.
+	OnBroadcastNoPeers func()
+	// Leaves the server once this many peers are alive, zero to stay: the
+	// peer stops polling the peer list and relays nothing, so data only
+	// goes direct, and keeps alive the peers it knows. It learns no new
+	// peers meanwhile. Meant for meshes whose peers all do so, as peers
+	// still polling forget those that left unless DeadAfter is set.
+	BootstrapPeers int
+	// Leaves the server after polling it this long even with fewer peers
+	// alive than BootstrapPeers, but at least one and RebootstrapBelow.
+	// Zero for no limit.
+	BootstrapTimeout time.Duration
+	// Contacts the server again once fewer peers than this are alive. At
+	// least one, so a peer left with none always does, and at most
+	// BootstrapPeers.
+	RebootstrapBelow int
+	// Assigns an id to senders of data not known yet, rather than ignoring
+	// their data, so the application can reply right away. Only senders of
+	// data relayed by the server, or of direct data with AuthDirect, and
+	// only once the data opened, up to 256 at a time. Like other peers,
+	// they are forgotten once complete peer lists leave them out.
+	AutoRegister bool
+	// Multicast group, e.g. "239.255.89.81:8982", to discover peers on the
+	// local network without a server. Peers announce themselves there on
+	// every tick and are forgotten once they stop. ServerAddress is ignored
+	// and data only goes direct, as with NoRelay. Best used with an
+	// unspecified LocalAddress.
+	Multicast string
+	// Hops announcements may travel, one if zero.
+	MulticastTTL int
+	// Advertised to other peers with every keep-alive and announcement, and
+	// to the server, which lists it, to show in PeerInfo and join events.
+	// Names are not unique and not used for routing.
+	Name string
+	// Advertised like Name and through the server's peer list, for peers
+	// to address the role-based subset of the mesh sharing it before
+	// exchanging keep-alives, see PeerHandle.BroadcastToGroup.
+	Group string
+	// Logs only messages of this peer of at least this level, so nodes of
+	// one process may log differently. SetLogLevel applies on top.
+	LogLevel LogLevel
+}
+
+// A snapshot of a node's counters.
+type Stats struct {
+	// Received messages by message type, e.g. "keepAlive" or "dataRelayTo".
+	Messages map[string]uint64
+	// Peer only. Start of the current period of server reachability, zero
+	// while the server is unreachable, and the number of times the server
+	// answered again after having been unreachable.
+	ServerConnectedSince time.Time
+	ServerReconnects     int
+	// Server only. Peers evicted due to MaxTrackedPeers.
+	Evicted uint64
+	// Server only. Relay requests refused as the sender was not
+	// registered.
+	UnregisteredRelays uint64
+	// Peer only. Datagrams recovered from parity, see PeerConfig.FECGroup.
+	Recovered uint64
+	Drops     Drops
+	Queues    Queues
+	// Bytes sent in the last full second, see PeerConfig.MaxOutboundBps.
+	OutboundRate uint64
+	// Internal goroutines running in the process, of all peers and
+	// servers. Should drop back once they all stopped, a steady rise
+	// hints at a leak.
+	Goroutines int64
+}
+
+// Datagrams dropped, by reason.
+type Drops struct {
+	// Received datagrams failing to decode.
+	DecodeError uint64
+	// Datagrams dropped by rate limits.
+	RateLimited uint64
+	// Datagrams dropped from a full send queue, see SendQueueSize.
+	QueueFull uint64
+	// Datagrams the socket failed to send.
+	WriteError uint64
+	// Relay requests and server data of unregistered senders, see
+	// UnregisteredRelays.
+	Unregistered uint64
+	// Datagrams exceeding the maximum datagram size.
+	TooLarge uint64
+	// Data failing authentication, see PeerConfig.AuthDirect and EndToEnd.
+	AuthFailed uint64
+	// Data rejected by PeerConfig.Filter or ServerConfig.RelayRouter.
+	Filtered uint64
+	// Relay requests the server already relayed, or relayed too often.
+	Looped uint64
+	// Failed writes dropped from a full retry buffer, see
+	// PeerConfig.RetryBuffer.
+	RetryOverflow uint64
+}
+
+// Drops as counted by the node's goroutines.
+type dropCounters struct {
+	decodeError   atomic.Uint64
+	rateLimited   atomic.Uint64
+	queueFull     atomic.Uint64
+	writeError    atomic.Uint64
+	unregistered  atomic.Uint64
+	tooLarge      atomic.Uint64
+	authFailed    atomic.Uint64
+	filtered      atomic.Uint64
+	looped        atomic.Uint64
+	retryOverflow atomic.Uint64
+	// Not drops, but just as shared, see Stats.Queues.
+	queues queueGauges
+	// Neither, see Stats.OutboundRate.
+	outbound bandwidth
+}
+
+func (d *dropCounters) snapshot() Drops {
+	return Drops{
+		DecodeError:   d.decodeError.Load(),
+		RateLimited:   d.rateLimited.Load(),
+		QueueFull:     d.queueFull.Load(),
+		WriteError:    d.writeError.Load(),
+		Unregistered:  d.unregistered.Load(),
+		TooLarge:      d.tooLarge.Load(),
+		AuthFailed:    d.authFailed.Load(),
+		Filtered:      d.filtered.Load(),
+		Looped:        d.looped.Load(),
+		RetryOverflow: d.retryOverflow.Load(),
+	}
+}
+
+func newStats() Stats {
+	return Stats{
+		Messages: make(map[string]uint64),
+	}
+}
+
+func (s Stats) clone() Stats {
+	c := s
+	c.Messages = make(map[string]uint64)
+	for k, v := range s.Messages {
+		c.Messages[k] = v
+	}
+	return c
+}
+
+type ServerConfig struct {
+	// Local address to listen on. Missing parts are filled in, an empty
+	// address listens on all interfaces on port 8981.
+	Address string
+	// Further local addresses to listen on as one server, e.g. one per
+	// public IP. Replies to a peer go out the socket it was last heard on.
+	Addresses []string
+	// Used instead of listening on Address and Addresses, if set.
+	Transport Transport
+	// As in PeerConfig.Network.
+	Network string
+	// As in PeerConfig.PcapWriter.
+	PcapWriter io.Writer
+	// Until a source proved it receives at its address, by echoing a
+	// cookie the server handed to it, send it at most this many times the
+	// bytes it sent, so spoofed requests cannot turn the server into an
+	// amplifier. Peers echo the cookie by themselves, registering one
+	// round trip later. 3, as in QUIC, is a good choice. Zero disables
+	// this.
+	AmplificationLimit int
+	// Defaults to the system clock.
+	Clock Clock
+	// Cap on the addresses in a single peer list. Larger sets are handed out
+	// in rotating pages, so a peer learns all others over several polls.
+	// Zero returns all addresses.
+	MaxPeersReturned int
+	// Cap on the registered peers. A new peer beyond it evicts the one
+	// heard from least recently, counted in Stats.Evicted. Zero is
+	// unbounded.
+	MaxTrackedPeers int
+	// Called from the server goroutine with every getPeerList. Returning
+	// false leaves the peer unregistered, dropping it if it was, and
+	// unanswered. Must not block, so back slow policy checks by a cache.
+	OnRegister func(from netip.AddrPort) bool
+	// Goroutines opening and decoding requests and checking their
+	// cookies. Peer state stays with the single server goroutine, while
+	// the order of the requests from each address is kept. Defaults to
+	// one.
+	Workers int
+	// Called from the server goroutine with data registered peers sent via
+	// PeerHandle.SendToServer. Must not block.
+	OnServerData func(from netip.AddrPort, data []byte)
+	// Called from the server goroutine whenever a relay request is dropped
+	// because the sender is not registered. Must not block.
+	OnUnregisteredRelay func(from netip.AddrPort)
+	// Called from the server goroutine with every relay request, returning
+	// the peer to relay the data to instead of to, or false to drop it.
+	// Targets must be registered, the data arrives as relayed from from.
+	// Data may be compressed or padded. Must not block.
+	RelayRouter func(from, to netip.AddrPort,
+		data []byte) (netip.AddrPort, bool)
+	// Called from the server goroutine with the source and version of peers
+	// registering with another ProtocolVersion, which are ignored. Must not
+	// block.
+	OnVersionMismatch func(from netip.AddrPort, version int)
+	// Only relay, for deployments discovering peers otherwise. Peer lists
+	// are empty, and any traffic registers its sender until it times out.
+	// OnRegister still applies.
+	RelayOnly bool
+	// Advertises the server as _mesher._udp.local via mDNS, for peers with
+	// MDNS to find it on the local network.
+	MDNS bool
+	// Datagrams read per system call on Linux, using recvmmsg. Zero or one
+	// reads them one by one.
+	ReadBatch int
+	// Datagrams written per system call on Linux, using sendmmsg. Zero or
+	// one writes them one by one. A batch is sent once WriteBatchWindow
+	// passed or it is full, a zero window sends what is queued right away.
+	WriteBatch       int
+	WriteBatchWindow time.Duration
+	// As in PeerConfig.DSCP.
+	DSCP int
+	// Prefix of every mesher datagram, to share the socket with other
+	// protocols. Either empty or 4 bytes long. Datagrams lacking it are
+	// passed to OnForeignPacket, or dropped if that is not set.
+	Magic []byte
+	// Called from the reader goroutine with every datagram lacking Magic.
+	// Must not block.
+	OnForeignPacket func(data []byte, from *net.UDPAddr)
+	// AES key of 16, 24 or 32 bytes shared by the server and its peers.
+	// All their traffic, control messages and relayed data alike, is then
+	// encrypted and authenticated. A server with a key only talks to peers
+	// with the same key.
+	ServerKey []byte
+	// As in PeerConfig.LogLevel.
+	LogLevel LogLevel
+}
+
+type ServerHandle struct {
+	done      chan struct{}
+	finished  chan struct{}
+	localAddr netip.AddrPort
+	commands  chan func(*server)
+	stopped   chan struct{}
+	conns     []Transport
+	// The done channels of the writers, see Healthy.
+	writers []chan struct{}
+}
+
+// Runs f inside the server goroutine. Returns false, if the server has
+// already stopped.
+func (h *ServerHandle) do(f func(s *server)) bool {
+	finished := make(chan struct{})
+	select {
+	case h.commands <- func(s *server) { f(s); close(finished) }:
+	case <-h.stopped:
+		return false
+	}
+	<-finished
+	return true
+}
+
+// The server's counters. Empty but for Goroutines once the server stopped.
+func (h *ServerHandle) Stats() Stats {
+	stats := newStats()
+	h.do(func(s *server) {
+		stats = s.stats.clone()
+		stats.Drops = s.drops.snapshot()
+		stats.Queues = s.drops.queues.snapshot()
+		stats.OutboundRate = s.drops.outbound.rate()
+	})
+	stats.Goroutines = goroutines.Load()
+	return stats
+}
+
+// Processes data as if it was a datagram from from, without the magic.
+// Meant for tests and extensions. Fails once the server stops reading.
+func (h *ServerHandle) Inject(from *net.UDPAddr, data []byte) error {
+	var err error
+	ok := h.do(func(s *server) {
+		if !s.reading {
+			err = ErrStopped
+			return
+		}
+		var m serverRequest
+		err = decode(data, &m)
+		if err == nil {
+			m = checkCookie(m, from, s.secret)
+			s.process(serverMessage{from, m, len(data)})
+		}
+	})
+	if !ok {
+		return ErrStopped
+	}
+	return err
+}
+
+// Unregisters the peer at addr right away, telling it so if notify is set.
+// Unless refused by OnRegister, the peer registers again with its next
+// poll.
+func (h *ServerHandle) Evict(addr netip.AddrPort, notify bool) error {
+	a := addrKey(net.UDPAddrFromAddrPort(addr))
+	var err error
+	ok := h.do(func(s *server) {
+		if _, ok := s.peers[a]; !ok {
+			err = ErrNotRegistered
+			return
+		}
+		s.logInfo("evicting", addr, "on request")
+		s.forget(a)
+		if notify {
+			s.responses <- response{to: addrFromKey(a), m: kicked{}}
+		}
+	})
+	if !ok {
+		return ErrStopped
+	}
+	return err
+}
+
+// Sends data to every registered peer, which passes it to its
+// OnServerNotice callback. Meant for administrative messages, e.g. about a
+// restart.
+func (h *ServerHandle) Notify(data []byte) error {
+	data = slices.Clone(data)
+	ok := h.do(func(s *server) {
+		s.logInfo("notifying", len(s.peers), "peers")
+		for a, _ := range s.peers {
+			s.responses <- response{to: addrFromKey(a), m: serverNotice{data}}
+		}
+	})
+	if !ok {
+		return ErrStopped
+	}
+	return nil
+}
+
+// Whether the server still reads from its sockets, processes requests and
+// writes to its sockets. Meant for liveness checks.
+func (h *ServerHandle) Healthy() bool {
+	for _, done := range h.writers {
+		// Receiving is harmless, a writer closes done right after.
+		select {
+		case <-done:
+			return false
+		default:
+		}
+	}
+	healthy := false
+	h.do(func(s *server) { healthy = s.reading })
+	return healthy
+}
+
+// The number of currently registered peers, zero once the server stopped.
+func (h *ServerHandle) ReadyPeers() int {
+	n := 0
+	h.do(func(s *server) { n = len(s.peers) })
+	return n
+}
+
+// Closed exactly once, when the server has completely shut down: its
+// sockets are closed and its readers, decoders and writers have exited.
+// Unlike the done channel of Server, which delivers a single value, any
+// number of receivers may wait on this one.
+func (h *ServerHandle) Done() <-chan struct{} {
+	return h.finished
+}
+
+// A peer registered with the server, see ServerHandle.State.
+type RegisteredPeer struct {
+	Address  netip.AddrPort
+	LastSeen time.Time
+	// Advertised private address, invalid if none, see
+	// PeerConfig.LocalPaths.
+	Private netip.AddrPort
+}
+
+// A snapshot of the server, see ServerHandle.State.
+type ServerState struct {
+	Peers []RegisteredPeer
+	// Peers following the peer list without registering.
+	Observers int
+	// See ServerHandle.Healthy.
+	Reading bool
+}
+
+// The registered peers and what the server knows about them. Empty once
+// the server stopped.
+func (h *ServerHandle) State() ServerState {
+	var state ServerState
+	h.do(func(s *server) {
+		for a, _ := range s.peers {
+			r := RegisteredPeer{
+				Address:  unmapped(addrFromKey(a)),
+				LastSeen: s.lastSeen[a],
+			}
+			if private, ok := s.privates[a]; ok {
+				r.Private = unmapped(addrFromKey(private))
+			}
+			state.Peers = append(state.Peers, r)
+		}
+		state.Observers = len(s.observers)
+		state.Reading = s.reading
+	})
+	return state
 }
 
+// Closes the server's sockets, which shuts it down. Wait on Done for the
+// shutdown to complete. Closing again is a no-op.
+func (h *ServerHandle) Close() error {
+	var err error
+	for _, conn := range h.conns {
+		e := conn.Close()
+		if e != nil && !errors.Is(e, net.ErrClosed) && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// The address the server actually listens on.
+func (h *ServerHandle) LocalAddr() netip.AddrPort {
+	return h.localAddr
+}
+
+// The sockets of the server, one per address, for socket options mesher
+// does not wrap. Entries are nil for Transports other than *net.UDPConn.
+// Only for options: reading, writing or closing breaks the server.
+func (h *ServerHandle) Conns() []*net.UDPConn {
+	conns := make([]*net.UDPConn, len(h.conns))
+	for i, c := range h.conns {
+		conns[i] = udpConn(c)
+	}
+	return conns
+}
+
+type PeerHandle struct {
+	broadcast chan []byte
+	done      chan struct{}
+	finished  chan struct{}
+	incoming  chan PeerMsg
+	events    chan PeerEvent
+	conn      Transport
+	sends     chan outgoing
+	ticks     chan time.Time
+	commands  chan func(*peer)
+	stopped   chan struct{}
+}
+
+// Returned by handle methods once the node has stopped.
+var ErrStopped = errors.New("mesher: stopped")
+
+// Returned by ServerHandle.Evict for addresses of no registered peer.
+var ErrNotRegistered = errors.New("mesher: not registered")
+
+// Returned by PeerHandle.Send for ids of no known peer.
+var ErrUnknownPeer = errors.New("mesher: unknown peer")
+
+// Runs one peer list refresh and keep-alive cycle. Only available with
+// PeerConfig.ManualTick.
+func (h *PeerHandle) Tick() error {
+	if h.ticks == nil {
+		return errors.New("mesher: Tick requires ManualTick")
+	}
+	select {
+	case h.ticks <- time.Time{}:
+		return nil
+	case <-h.stopped:
+		return ErrStopped
+	}
+}
+
+// Broadcasts data like the broadcast channel, but datagrams still queued
+// for sending at deadline are dropped instead of sent.
+func (h *PeerHandle) SendWithDeadline(data []byte, deadline time.Time) error {
+	select {
+	case h.sends <- outgoing{buf: data, deadline: deadline}:
+		return nil
+	case <-h.stopped:
+		return ErrStopped
+	}
+}
+
+// Broadcasts data like the broadcast channel. The future resolves once
+// the datagrams to all peers were written or dropped.
+func (h *PeerHandle) SendAsync(data []byte) *Future {
+	f := newFuture()
+	select {
+	case h.sends <- outgoing{buf: data, future: f}:
+	case <-h.stopped:
+		f.resolve(ErrStopped)
+	}
+	return f
+}
+
+// Sends data to the server application, see ServerConfig.OnServerData.
+// Like all datagrams it may be lost.
+func (h *PeerHandle) SendToServer(data []byte) error {
+	select {
+	case h.sends <- outgoing{buf: data, toServer: true}:
+		return nil
+	case <-h.stopped:
+		return ErrStopped
+	}
+}
+
+// Runs f inside the peer goroutine. Returns false, if the peer has already
+// stopped.
+func (h *PeerHandle) do(f func(p *peer)) bool {
+	finished := make(chan struct{})
+	select {
+	case h.commands <- func(p *peer) { f(p); close(finished) }:
+	case <-h.stopped:
+		return false
+	}
+	<-finished
+	return true
+}
+
+// The peer's counters. Empty but for Goroutines once the peer stopped.
+func (h *PeerHandle) Stats() Stats {
+	stats := newStats()
+	h.do(func(p *peer) {
+		stats = p.stats.clone()
+		stats.Drops = p.drops.snapshot()
+		stats.Queues = p.drops.queues.snapshot()
+		stats.OutboundRate = p.drops.outbound.rate()
+	})
+	stats.Goroutines = goroutines.Load()
+	return stats
+}
+
+// Processes data as if it was a datagram from from, without the magic.
+// Meant for tests and extensions. Fails once the peer stops reading.
+func (h *PeerHandle) Inject(from *net.UDPAddr, data []byte) error {
+	var err error
+	ok := h.do(func(p *peer) {
+		if !p.reading {
+			err = ErrStopped
+			return
+		}
+		var m peerRequest
+		m, err = decodePeerRequest(data)
+		if err != nil {
+			p.logDebug("ignoring", err, from)
+			p.drops.decodeError.Add(1)
+			return
+		}
+		p.process(peerMessage{from, m})
+	})
+	if !ok {
+		return ErrStopped
+	}
+	return err
+}
+
+// The currently known peers by id. Empty once the peer stopped.
+func (h *PeerHandle) Peers() []PeerInfo {
+	var peers []PeerInfo
+	h.do(func(p *peer) {
+		for a, id := range p.peerIds {
+			direct := p.direct(a)
+			peers = append(peers, PeerInfo{
+				Id:          id,
+				Address:     unmapped(addrFromKey(a)),
+				Name:        p.names[a],
+				Group:       p.groups[a],
+				Direct:      direct,
+				Stale:       p.isStale(a),
+				ClockOffset: p.skews[a].offset,
+				RoundTrip:   p.skews[a].delay,
+			})
+		}
+	})
+	slices.SortFunc(peers, func(x, y PeerInfo) int { return cmp.Compare(x.Id, y.Id) })
+	return peers
+}
+
+// The number of peers registered with the server including this one, as of
+// the last peer list. 1 means the peer is alone, 0 that no list arrived
+// yet. Always 0 in discovery mode.
+func (h *PeerHandle) MeshSize() int {
+	n := 0
+	h.do(func(p *peer) { n = p.meshSize })
+	return n
+}
+
+// Whether data to the peer with peerId currently goes direct, as in
+// PeerInfo.Direct. False for unknown ids, for peers only reachable via the
+// relay and once the peer stopped.
+func (h *PeerHandle) IsDirect(peerId uint64) bool {
+	direct := false
+	h.do(func(p *peer) {
+		for a, id := range p.peerIds {
+			if id == peerId {
+				direct = p.direct(a)
+				return
+			}
+		}
+	})
+	return direct
+}
+
+// Broadcasts data like the broadcast channel, so data may still be
+// buffered when it returns, see Channels. Unlike sending on that, it fails
+// instead of blocking forever once the peer stopped.
+func (h *PeerHandle) Broadcast(data []byte) error {
+	select {
+	case h.broadcast <- data:
+		return nil
+	case <-h.stopped:
+		return ErrStopped
+	}
+}
+
+// Broadcasts every payload in turn like the broadcast channel, in a single
+// hand-off to the peer goroutine rather than one per payload. Returns the
+// first error of any payload. See WriteBatch for fewer system calls.
+func (h *PeerHandle) BroadcastBatch(batch [][]byte) error {
+	var err error
+	ok := h.do(func(p *peer) {
+		p.active(p.responses)
+		for _, data := range batch {
+			e := p.broadcast(outgoing{buf: data}, p.responses)
+			if err == nil {
+				err = e
+			}
+		}
+	})
+	if !ok {
+		return ErrStopped
+	}
+	return err
+}
+
+// Sends data to the peer with peerId alone, directly or relayed like a
+// broadcast.
+func (h *PeerHandle) Send(peerId uint64, data []byte) error {
+	err := ErrUnknownPeer
+	ok := h.do(func(p *peer) {
+		a := p.addressOf(peerId)
+		if _, known := p.peerIds[a]; !known {
+			return
+		}
+		if p.config.Observer {
+			p.logDebug("observer does not send, dropping data")
+			err = ErrDropped
+			return
+		}
+		p.active(p.responses)
+		p.sendTo(a, outgoing{buf: data}, p.responses)
+		err = nil
+	})
+	if !ok {
+		return ErrStopped
+	}
+	return err
+}
+
+// The data handed over by the peer, the incoming channel of Peer. Closed
+// once the peer stopped.
+func (h *PeerHandle) Recv() <-chan PeerMsg {
+	return h.incoming
+}
+
+// Closes the peer's socket, which shuts it down. Wait on Done for the
+// shutdown to complete. Closing again is a no-op.
+func (h *PeerHandle) Close() error {
+	err := h.conn.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// Closed exactly once, when the peer has completely shut down, as in
+// ServerHandle.Done. Unlike the done channel of Peer, which delivers a
+// single value, any number of receivers may wait on this one.
+func (h *PeerHandle) Done() <-chan struct{} {
+	return h.finished
+}
+
+// The broadcast, done and incoming channels as returned by Peer. The
+// broadcast channel buffers up to 64 datagrams, so a completed send does
+// not mean the peer took the data, and what is still buffered when the
+// peer stops is dropped. Once the buffer is full, sends on a stopped peer
+// block forever, see Broadcast. Kept for compatibility, the handle's
+// methods are preferred.
+func (h *PeerHandle) Channels() (chan []byte, chan struct{}, chan PeerMsg) {
+	return h.broadcast, h.done, h.incoming
+}
+
+// The address the peer actually listens on. It changes, when the socket
+// is rebound.
+func (h *PeerHandle) LocalAddr() netip.AddrPort {
+	return localAddrPort(h.conn)
+}
+
+// The socket of the peer, for socket options mesher does not wrap. Nil for
+// Transports other than *net.UDPConn. Only for options: reading, writing
+// or closing breaks the peer. A rebind replaces the socket, so fetch it
+// again from OnRebind.
+func (h *PeerHandle) Conn() *net.UDPConn {
+	return udpConn(h.conn)
+}
+
+func udpConn(t Transport) *net.UDPConn {
+	switch c := t.(type) {
+	case *net.UDPConn:
+		return c
+	case *rebindingConn:
+		return c.current()
+	}
+	return nil
+}
+
+const defaultServerPort = "8981"
+
+const defaultSendQueueSize = 64
+
+const defaultMaxIdleInterval = time.Minute
+
+const defaultPeerTimeout = 5 * time.Second
+
+const defaultAckTimeout = 5 * time.Second
+
+const (
+	defaultWarmupInterval = 500 * time.Millisecond
+	defaultWarmupPeriod   = 3 * time.Second
+)
+
+// Fills in the port of an address lacking one, so "" becomes ":port" and
+// "127.0.0.1" becomes "127.0.0.1:port".
+func completeAddress(address, port string) string {
+	_, _, err := net.SplitHostPort(address)
+	if err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), port)
+}
+
+// The address with IPv4-mapped IPv6 addresses turned into IPv4 ones.
+func unmapped(a *net.UDPAddr) netip.AddrPort {
+	return netip.AddrPortFrom(a.AddrPort().Addr().Unmap(), a.AddrPort().Port())
+}
+
+func localAddrPort(conn Transport) netip.AddrPort {
+	a, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	return a.AddrPort()
+}
+
+const magicSize = 4
+
+func checkMagic(magic []byte) {
+	if len(magic) != 0 && len(magic) != magicSize {
+		log.Fatal("magic must be ", magicSize, " bytes long, not ", len(magic))
+	}
+}
+
+// The messages of the protocol, as registered with gob.
+var messages = []interface{}{getPeerList{}, peerList{}, keepAlive{},
+	isAlive{}, dataRelayTo{}, dataRelayedFrom{}, dataDirect{}, mtuProbe{},
+	mtuAck{}, relayTokens{}, dataRelayToken{}, serverData{}, announce{},
+	kicked{}, serverNotice{}, dataAck{}, ackRelayTo{}, ackRelayedFrom{}}
+
+func registerMessages() {
+	for _, m := range messages {
+		gob.Register(m)
+	}
+}
+
+// Runs a server on serverAddress, returning the done channel of
+// ServerWithConfig. Kept for compatibility, the ServerHandle of
+// ServerWithConfig also queries and administers the server.
 func Server(serverAddress string) chan struct{} {
-	gob.Register(getPeerList{})
-	gob.Register(peerList{})
-	gob.Register(keepAlive{})
-	gob.Register(isAlive{})
-	gob.Register(dataRelayTo{})
-	gob.Register(dataRelayedFrom{})
-	gob.Register(dataDirect{})
-
-	serverAddressUDP, err := net.ResolveUDPAddr("udp", serverAddress)
-	if err != nil {
-		log.Fatal(err)
+	return ServerWithConfig(ServerConfig{Address: serverAddress}).done
+}
+
+func ServerWithConfig(config ServerConfig) *ServerHandle {
+	registerMessages()
+	checkMagic(config.Magic)
+
+	config.Clock = clockOrDefault(config.Clock)
+	if config.Network == "" {
+		config.Network = "udp"
 	}
-	conn, err := net.ListenUDP("udp", serverAddressUDP)
-	if err != nil {
-		log.Fatal(err)
+	l := logger{config.LogLevel}
+
+	conns := []Transport{config.Transport}
+	if config.Transport == nil {
+		conns[0] = listenServer(config.Network, config.Address)
+		for _, a := range config.Addresses {
+			conns = append(conns, listenServer(config.Network, a))
+		}
+	}
+	localAddr := localAddrPort(conns[0])
+	for _, conn := range conns {
+		l.logInfo("server listening on", localAddrPort(conn))
+		setDSCP(conn, config.DSCP, l)
+	}
+	stopped := make(chan struct{})
+	if config.MDNS {
+		advertiseMDNS(localAddr.Port(), stopped, l)
 	}
 
-	request := reader(conn)
-	out := meshServer(request)
-	innerDone := writer(conn, out)
+	commands := make(chan func(*server))
+	f := framing{l, config.Magic, config.OnForeignPacket,
+		newSealing(config.ServerKey, nil, l), nil,
+		newPcapWriter(config.PcapWriter, config.Clock, l)}
+	var sockets *serverSockets
+	// The readers and decoders, see ServerHandle.Done.
+	var running sync.WaitGroup
+	var readers []chan request
+	for _, conn := range conns {
+		readers = append(readers, reader(conn, config.ReadBatch, f,
+			&running))
+	}
+	request := readers[0]
+	if len(conns) > 1 {
+		sockets = newServerSockets()
+		request = sockets.inbound(readers)
+	}
+	workers := max(config.Workers, 1)
+	drops := &dropCounters{}
+	drops.outbound.init(0, config.Clock)
+	drops.queues.requests.depth = func() int { return len(request) }
+	// Shared with the decoders, which check cookies.
+	secret := newSecret()
+	decoded := serverDecoders(request, workers, drops, f, secret,
+		&running)
+	out := meshServer(config, decoded, commands, stopped, drops, sockets,
+		secret)
+	// Queued, so a stalled socket cannot block the server goroutine.
+	queued := []chan response{fairQueue(out, defaultSendQueueSize, drops,
+		f.logger)}
+	if sockets != nil {
+		queued = sockets.outbound(queued[0], len(conns))
+	}
+	var innerDone []chan struct{}
+	for i, conn := range conns {
+		innerDone = append(innerDone, writer(conn, queued[i], maxDatagram,
+			config.Clock, config.WriteBatch, config.WriteBatchWindow, f, nil,
+			drops))
+	}
 
-	done := make(chan struct{})
+	// Buffered, so shutting down completes without a receiver.
+	done := make(chan struct{}, 1)
+	finished := make(chan struct{})
 	go func() {
-		<-innerDone
-		log.Println("All goroutines done, closing connection, sending 'done'-signal, closing 'done'-channel")
-		conn.Close()
+		defer live()()
+		for i, conn := range conns {
+			<-innerDone[i]
+			conn.Close()
+		}
+		running.Wait()
+		close(finished)
+		l.logDebug("All goroutines done, closed connections, sending 'done'-signal, closing 'done'-channel")
 		done <- struct{}{}
 		close(done)
 	}()
-	return done
+	return &ServerHandle{done, finished, localAddr, commands, stopped, conns,
+		innerDone}
 }
 
+// Runs a peer on localAddress, returning the channels of
+// PeerHandle.Channels, whose broadcast channel is buffered. Kept for
+// compatibility, the PeerHandle of PeerWithConfig is preferred.
 func Peer(localAddress, serverAddress string) (chan []byte, chan struct{}, chan PeerMsg) {
-	gob.Register(getPeerList{})
-	gob.Register(peerList{})
-	gob.Register(keepAlive{})
-	gob.Register(isAlive{})
-	gob.Register(dataRelayTo{})
-	gob.Register(dataRelayedFrom{})
-	gob.Register(dataDirect{})
-
-	serverAddressUdp, err := net.ResolveUDPAddr("udp", serverAddress)
-	if err != nil {
-		log.Fatal(err)
+	return PeerWithConfig(PeerConfig{
+		LocalAddress:  localAddress,
+		ServerAddress: serverAddress,
+	}).Channels()
+}
+
+func PeerWithConfig(config PeerConfig) *PeerHandle {
+	registerMessages()
+	checkMagic(config.Magic)
+	l := logger{config.LogLevel}
+	if config.Network == "" {
+		config.Network = "udp"
 	}
 
-	localAddressUDP, err := net.ResolveUDPAddr("udp", localAddress)
-	if err != nil {
-		log.Fatal(err)
+	var serverAddressUdp, group *net.UDPAddr
+	// Of the servers, to resolve again, none for servers found via mDNS.
+	var names []string
+	var err error
+	if config.Multicast != "" {
+		groupAddress := completeAddress(config.Multicast, defaultDiscoveryPort)
+		group, err = net.ResolveUDPAddr(config.Network, groupAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.NoRelay = true
+	} else if config.MDNS && config.ServerAddress == "" {
+		serverAddressUdp, err = resolveMDNS(l)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		serverAddress := completeAddress(config.ServerAddress, defaultServerPort)
+		serverAddressUdp, err = net.ResolveUDPAddr(config.Network,
+			serverAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		names = append(names, serverAddress)
 	}
 
-	conn, err := net.ListenUDP("udp", localAddressUDP)
-	if err != nil {
-		log.Fatal(err)
+	var servers []*net.UDPAddr
+	if serverAddressUdp != nil {
+		servers = append(servers, serverAddressUdp)
+		for _, s := range config.FallbackServers {
+			name := completeAddress(s, defaultServerPort)
+			fallback, err := net.ResolveUDPAddr(config.Network, name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			servers = append(servers, fallback)
+			if names != nil {
+				names = append(names, name)
+			}
+		}
 	}
 
-	done := make(chan struct{})
-	broadcast := make(chan []byte)
+	config.Clock = clockOrDefault(config.Clock)
+	if config.MaxDatagram <= 0 || config.MaxDatagram > maxDatagram {
+		config.MaxDatagram = maxDatagram
+	}
+	if config.MaxDatagram < minDatagram {
+		config.MaxDatagram = minDatagram
+	}
+	codecs := make([]string, 0, len(config.Codecs))
+	for _, c := range config.Codecs {
+		if !knownCodec(c) {
+			l.logWarn("ignoring unknown codec", c)
+			continue
+		}
+		codecs = append(codecs, c)
+	}
+	config.Codecs = codecs
+	if config.WarmupInterval <= 0 {
+		config.WarmupInterval = defaultWarmupInterval
+	}
+	if config.WarmupPeriod == 0 {
+		config.WarmupPeriod = defaultWarmupPeriod
+	}
+	if config.AckTimeout <= 0 {
+		config.AckTimeout = defaultAckTimeout
+	}
+	if config.PeerTimeout <= 0 {
+		config.PeerTimeout = defaultPeerTimeout
+	}
+	if config.MaxIdleInterval <= 0 {
+		config.MaxIdleInterval = defaultMaxIdleInterval
+	}
+	if config.SendQueueSize <= 0 {
+		config.SendQueueSize = defaultSendQueueSize
+	}
+	config.FECGroup = min(config.FECGroup, fecMaxGroup)
+	if config.PadTo > config.MaxDatagram-padOverhead {
+		config.PadTo = max(config.MaxDatagram-padOverhead, 0)
+		l.logWarn("PadTo leaves no room for headers, lowering it to",
+			config.PadTo)
+	}
+	if config.BootstrapPeers > 0 &&
+		config.RebootstrapBelow > config.BootstrapPeers {
+		l.logWarn("RebootstrapBelow exceeds BootstrapPeers, lowering it")
+		config.RebootstrapBelow = config.BootstrapPeers
+	}
+
+	conn := config.Transport
+	if conn == nil {
+		localAddress := completeAddress(config.LocalAddress, "0")
+		localAddressUDP, err := net.ResolveUDPAddr(config.Network,
+			localAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conn, err = net.ListenUDP(config.Network, localAddressUDP)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if group != nil {
+		setMulticastTTL(conn, group, config.MulticastTTL, l)
+	}
+	setDSCP(conn, config.DSCP, l)
+	var rebound chan netip.AddrPort
+	if config.Rebind {
+		c, ok := conn.(*net.UDPConn)
+		if ok {
+			rc := newRebindingConn(c, config.Network, l)
+			rc.prepare = func(c *net.UDPConn) { setDSCP(c, config.DSCP, l) }
+			conn = rc
+			rebound = rc.rebound
+		} else {
+			l.logWarn("Rebind needs a socket of its own, ignoring it")
+		}
+	}
+	localAddr := localAddrPort(conn)
+	l.logInfo("peer listening on", localAddr)
+
+	// Buffered, so shutting down completes without a receiver.
+	done := make(chan struct{}, 1)
+	finished := make(chan struct{})
+	broadcast := make(chan []byte, channelCapacity)
 
-	request := reader(conn)
-	incoming, out := meshPeer(serverAddressUdp, request, broadcast)
-	innerDone := writer(conn, out)
+	sends := make(chan outgoing)
+	commands := make(chan func(*peer))
+	stopped := make(chan struct{})
+	f := framing{
+		logger:  l,
+		magic:   config.Magic,
+		foreign: config.OnForeignPacket,
+		capture: newPcapWriter(config.PcapWriter, config.Clock, l),
+	}
+	if serverAddressUdp != nil {
+		f.sealing = newSealing(config.ServerKey, servers, l)
+	}
+	if config.LocalPaths && serverAddressUdp != nil {
+		f.lan = newLANRoutes(l)
+	}
+	drops := &dropCounters{}
+	drops.outbound.init(config.MaxOutboundBps, config.Clock)
+	// The readers and decoders, see PeerHandle.Done.
+	var running sync.WaitGroup
+	request := reader(conn, config.ReadBatch, f, &running)
+	drops.queues.requests.depth = func() int { return len(request) }
+	drops.queues.broadcast.depth = func() int { return len(broadcast) }
+	var ticks chan time.Time
+	var ticker <-chan time.Time
+	if config.ManualTick {
+		ticks = make(chan time.Time)
+		ticker = ticks
+	} else {
+		ticker = config.Clock.Tick(3 * time.Second)
+	}
+	if group != nil {
+		listenAnnouncements(config.Network, group, f, commands, stopped,
+			&running)
+	}
+	resolve := make(chan struct{}, 1)
+	events := make(chan PeerEvent, channelCapacity)
+	if names != nil {
+		resolveServers(names, servers, config.Network, config.ResolveInterval,
+			config.Clock, resolve, f.sealing, commands, stopped, l)
+	}
+	keys := newKeyring(config)
+	decoded := peerDecoders(request, max(config.Workers, 1), drops, f,
+		keys, &running)
+	incoming, out := meshPeer(config, localAddr, servers, group,
+		decoded, broadcast, sends, ticker, rebound, commands, stopped, drops,
+		f.lan, resolve, events, keys)
+	if f.lan != nil {
+		out = f.lan.outbound(out)
+	}
+	queued := fairQueue(out, config.SendQueueSize, drops, f.logger)
+	retries := newRetryBuffer(config.RetryBuffer, drops, l)
+	innerDone := writer(conn, retrying(queued, retries, config.Clock),
+		config.MaxDatagram, config.Clock, config.WriteBatch,
+		config.WriteBatchWindow, f, retries, drops)
 
 	go func() {
+		defer live()()
 		<-innerDone
 		conn.Close()
+		running.Wait()
+		close(finished)
 		done <- struct{}{}
 	}()
-	return broadcast, done, incoming
+	return &PeerHandle{broadcast, done, finished, incoming, events, conn,
+		sends, ticks, commands, stopped}
 }
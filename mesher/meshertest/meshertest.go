@@ -0,0 +1,323 @@
+// Package meshertest runs a mesher server and peers in-process on an
+// in-memory network driven by a manual clock.
+package meshertest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mesher/mesher"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+/******************************************************************************/
+/* CLOCK                                                                      */
+/******************************************************************************/
+
+type waiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+// A mesher.Clock that only moves forward when Advance is called.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+func NewClock() *Clock {
+	return &Clock{now: time.Unix(0, 0)}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0)
+}
+
+func (c *Clock) Tick(d time.Duration) <-chan time.Time {
+	return c.add(d, d)
+}
+
+func (c *Clock) add(d, period time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &waiter{c.now.Add(d), period, make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	return w.c
+}
+
+// Moves the clock forward and fires every timer that became due. Like
+// time.Ticker, a ticker whose last tick was not received drops ticks.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		select {
+		case w.c <- c.now:
+		default:
+		}
+		if w.period > 0 {
+			for !w.at.After(c.now) {
+				w.at = w.at.Add(w.period)
+			}
+			pending = append(pending, w)
+		}
+	}
+	c.waiters = pending
+}
+
+/******************************************************************************/
+/* NETWORK                                                                    */
+/******************************************************************************/
+
+type packet struct {
+	from *net.UDPAddr
+	buf  []byte
+}
+
+// An in-memory datagram network. Packets to unknown addresses or to full
+// receive queues are dropped, like UDP would.
+type Network struct {
+	mu       sync.Mutex
+	conns    map[netip.AddrPort]*Conn
+	nextPort uint16
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		conns:    make(map[netip.AddrPort]*Conn),
+		nextPort: 10000,
+	}
+}
+
+// Opens a connection on a fresh loopback port.
+func (n *Network) Listen() *Conn {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addr := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), n.nextPort)
+	n.nextPort += 1
+	c := &Conn{
+		network: n,
+		addr:    addr,
+		in:      make(chan packet, 1024),
+		closed:  make(chan struct{}),
+	}
+	n.conns[addr] = c
+	return c
+}
+
+func (n *Network) deliver(from, to netip.AddrPort, b []byte) {
+	n.mu.Lock()
+	c, ok := n.conns[to]
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+	cp := make([]byte, len(b))
+	copy(cp, b)
+	select {
+	case c.in <- packet{net.UDPAddrFromAddrPort(from), cp}:
+	default:
+	}
+}
+
+// A mesher.Transport on a Network.
+type Conn struct {
+	network   *Network
+	addr      netip.AddrPort
+	in        chan packet
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *Conn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case p := <-c.in:
+		return copy(b, p.buf), p.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *Conn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	to := netip.AddrPortFrom(addr.AddrPort().Addr().Unmap(), addr.AddrPort().Port())
+	c.network.deliver(c.addr, to, b)
+	return len(b), nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.addr)
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.network.mu.Lock()
+		delete(c.network.conns, c.addr)
+		c.network.mu.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
+
+/******************************************************************************/
+/* MESH                                                                       */
+/******************************************************************************/
+
+// A server and peers wired over an in-memory network.
+type Mesh struct {
+	Network  *Network
+	Clock    *Clock
+	Server   *mesher.ServerHandle
+	Peers    []*mesher.PeerHandle
+	conns    []*Conn
+	received []chan mesher.PeerMsg
+}
+
+// Starts a server and n peers. Each peer is configured by configure, if
+// given, before its transport, clock and server address are filled in.
+func New(n int, configure func(i int, c *mesher.PeerConfig)) *Mesh {
+	m := &Mesh{
+		Network: NewNetwork(),
+		Clock:   NewClock(),
+	}
+	serverConn := m.Network.Listen()
+	m.conns = append(m.conns, serverConn)
+	m.Server = mesher.ServerWithConfig(mesher.ServerConfig{
+		Transport: serverConn,
+		Clock:     m.Clock,
+	})
+	for i := 0; i < n; i++ {
+		var config mesher.PeerConfig
+		if configure != nil {
+			configure(i, &config)
+		}
+		conn := m.Network.Listen()
+		m.conns = append(m.conns, conn)
+		config.Transport = conn
+		config.Clock = m.Clock
+		config.ServerAddress = serverConn.addr.String()
+		h := mesher.PeerWithConfig(config)
+		m.Peers = append(m.Peers, h)
+		received := make(chan mesher.PeerMsg, 1024)
+		m.received = append(m.received, received)
+		_, _, incoming := h.Channels()
+		go func() {
+			for msg := range incoming {
+				received <- msg
+			}
+			close(received)
+		}()
+	}
+	return m
+}
+
+// Advances the clock by one second and gives the goroutines time to react.
+func (m *Mesh) Step() {
+	m.Clock.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+}
+
+// Steps the clock until a broadcast of every peer reaches all other peers.
+func (m *Mesh) WaitConnected(steps int) error {
+	for i := 0; i < steps; i++ {
+		m.Step()
+		connected := true
+		for p := range m.Peers {
+			probe := []byte(fmt.Sprint("meshertest probe ", i, " ", p))
+			_, err := m.SendAndReceive(p, probe, 100*time.Millisecond)
+			if err != nil {
+				connected = false
+				break
+			}
+		}
+		if connected {
+			return nil
+		}
+	}
+	return errors.New("mesh did not connect")
+}
+
+// Broadcasts data from peer from and waits until every other peer received
+// it. Returns the received messages indexed by peer, nil for the sender.
+func (m *Mesh) SendAndReceive(from int, data []byte,
+	timeout time.Duration) ([]*mesher.PeerMsg, error) {
+	got := make([]*mesher.PeerMsg, len(m.Peers))
+	err := m.Peers[from].Broadcast(data)
+	if err != nil {
+		return got, err
+	}
+	deadline := time.After(timeout)
+	for i, received := range m.received {
+		if i == from {
+			continue
+		}
+		for got[i] == nil {
+			select {
+			case msg, ok := <-received:
+				if !ok {
+					return got, fmt.Errorf("peer %d shut down", i)
+				}
+				if bytes.Equal(msg.Buf, data) {
+					got[i] = &msg
+				}
+			case <-deadline:
+				return got, fmt.Errorf("peer %d did not receive data", i)
+			}
+		}
+	}
+	return got, nil
+}
+
+// Processes data on peer i as if it was a datagram from from, e.g. to
+// exercise a message handler without networking.
+func (m *Mesh) InjectPeer(i int, from netip.AddrPort, data []byte) error {
+	return m.Peers[i].Inject(net.UDPAddrFromAddrPort(from), data)
+}
+
+// Processes data on the server as if it was a datagram from from.
+func (m *Mesh) InjectServer(from netip.AddrPort, data []byte) error {
+	return m.Server.Inject(net.UDPAddrFromAddrPort(from), data)
+}
+
+// Closes all connections and steps the clock until everything shut down.
+func (m *Mesh) Close() {
+	for _, c := range m.conns {
+		c.Close()
+	}
+	for _, h := range m.Peers {
+		m.stepUntil(h.Done())
+	}
+	m.stepUntil(m.Server.Done())
+}
+
+func (m *Mesh) stepUntil(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			m.Step()
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package meshertest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	c := NewClock()
+	after := c.After(2 * time.Second)
+	tick := c.Tick(time.Second)
+	c.Advance(time.Second)
+	select {
+	case <-after:
+		t.Error("timer fired early")
+	default:
+	}
+	<-tick
+	c.Advance(time.Second)
+	<-after
+	<-tick
+}
+
+func TestMesh(t *testing.T) {
+	m := New(3, nil)
+	defer m.Close()
+	if err := m.WaitConnected(30); err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.SendAndReceive(0, []byte("hello"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != nil || got[1] == nil || got[2] == nil {
+		t.Errorf("received %v", got)
+	}
+	if n := m.Server.ReadyPeers(); n != 3 {
+		t.Errorf("server has %d peers, want 3", n)
+	}
+}
@@ -0,0 +1,17 @@
+package mesher
+
+import "testing"
+
+// Probes must make datagrams of exactly the size probed.
+func TestMTUProbeSize(t *testing.T) {
+	registerMessages()
+	magic := []byte("MESH")
+	for _, size := range []int{minDatagram, 1400, 1500, maxDatagram} {
+		r := response{to: testAddr(2), m: newMTUProbe(size, magic)}
+		b, ok := encodeResponse(r, maxDatagram, newTestClock(),
+			framing{magic: magic}, &dropCounters{})
+		if !ok || len(b) != size {
+			t.Errorf("probe of %d bytes made a datagram of %d", size, len(b))
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package mesher
+
+import (
+	"net/netip"
+)
+
+/******************************************************************************/
+/* NAT                                                                        */
+/******************************************************************************/
+
+// Called with the address the server sees the peer at. A change means the
+// NAT mapped the peer anew, which likely broke the direct paths, so they
+// are probed again from scratch.
+func (p *peer) observed(a address, responses chan response) {
+	if a == (address{}) {
+		return
+	}
+	old := p.publicAddr
+	p.publicAddr = a
+	if old == (address{}) || old == a {
+		return
+	}
+	p.logInfo("public address changed from", addrFromKey(old), "to",
+		addrFromKey(a))
+	if p.config.OnNATRebind != nil {
+		p.config.OnNATRebind(unmapped(addrFromKey(old)),
+			unmapped(addrFromKey(a)))
+	}
+	for addr := range p.peerIds {
+		delete(p.alivePeers, addr)
+		delete(p.pendingAlive, addr)
+		delete(p.confirmedDirect, addr)
+		delete(p.directFailures, addr)
+		delete(p.relayOnly, addr)
+		delete(p.mtu, addr)
+		p.checkRoute(addr)
+	}
+	p.keepAlive(responses)
+}
+
+// The address the server last saw the peer at, invalid before the first
+// peer list.
+func (h *PeerHandle) PublicAddr() netip.AddrPort {
+	var a netip.AddrPort
+	h.do(func(p *peer) {
+		if p.publicAddr != (address{}) {
+			a = unmapped(addrFromKey(p.publicAddr))
+		}
+	})
+	return a
+}
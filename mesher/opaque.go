@@ -0,0 +1,106 @@
+package mesher
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+/******************************************************************************/
+/* OPAQUE                                                                     */
+/******************************************************************************/
+
+// Direct data framed by a fixed binary header instead of gob, see
+// PeerConfig.Opaque. After the magic:
+//
+//	0      0x00, which never starts a gob stream
+//	1      flags
+//	2-9    Origin
+//	10-17  Seq
+//	18-19  Parity
+//	20-21  Stream
+//	       MAC, if flagged
+//	       the payload, verbatim
+type dataOpaque struct {
+	dataDirect
+}
+
+const (
+	opaqueMarker     = 0x00
+	opaqueHeaderSize = 22
+	opaqueFlagMAC    = 1
+	opaqueFlagAck    = 2
+	opaqueFlagPad    = 4
+	opaqueFlagE2E    = 8
+)
+
+func isOpaque(buf []byte) bool {
+	return len(buf) > 0 && buf[0] == opaqueMarker
+}
+
+func (m dataOpaque) frame() []byte {
+	buf := make([]byte, opaqueHeaderSize,
+		opaqueHeaderSize+len(m.MAC)+len(m.Data))
+	buf[0] = opaqueMarker
+	if m.MAC != nil {
+		buf[1] |= opaqueFlagMAC
+	}
+	if m.Ack {
+		buf[1] |= opaqueFlagAck
+	}
+	if strings.Contains(m.Codec, padSuffix) {
+		buf[1] |= opaqueFlagPad
+	}
+	if strings.HasSuffix(m.Codec, e2eSuffix) {
+		buf[1] |= opaqueFlagE2E
+	}
+	binary.BigEndian.PutUint64(buf[2:], m.Origin)
+	binary.BigEndian.PutUint64(buf[10:], m.Seq)
+	binary.BigEndian.PutUint16(buf[18:], uint16(m.Parity))
+	binary.BigEndian.PutUint16(buf[20:], m.Stream)
+	buf = append(buf, m.MAC...)
+	return append(buf, m.Data...)
+}
+
+func decodeOpaque(buf []byte) (dataOpaque, error) {
+	var m dataOpaque
+	if len(buf) < opaqueHeaderSize {
+		return m, errors.New("truncated opaque header")
+	}
+	flags := buf[1]
+	m.Ack = flags&opaqueFlagAck != 0
+	if flags&opaqueFlagPad != 0 {
+		m.Codec += padSuffix
+	}
+	if flags&opaqueFlagE2E != 0 {
+		m.Codec += e2eSuffix
+	}
+	m.Origin = binary.BigEndian.Uint64(buf[2:])
+	m.Seq = binary.BigEndian.Uint64(buf[10:])
+	m.Parity = int(binary.BigEndian.Uint16(buf[18:]))
+	m.Stream = binary.BigEndian.Uint16(buf[20:])
+	buf = buf[opaqueHeaderSize:]
+	if flags&opaqueFlagMAC != 0 {
+		if len(buf) < authMACSize {
+			return m, errors.New("truncated opaque MAC")
+		}
+		m.MAC = buf[:authMACSize]
+		buf = buf[authMACSize:]
+	}
+	m.Data = buf
+	return m, nil
+}
+
+// The message carrying direct data d to a.
+func (p *peer) directData(a address, d dataDirect) interface{} {
+	d = p.sign(a, d)
+	if p.opaque(a) {
+		return dataOpaque{d}
+	}
+	return d
+}
+
+// Whether direct data to a goes opaque.
+func (p *peer) opaque(a address) bool {
+	return p.config.Opaque && p.supports(a, capOpaque)
+}
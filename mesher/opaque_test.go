@@ -0,0 +1,34 @@
+package mesher
+
+import "testing"
+
+// Encodes and decodes direct data as gob and opaque, reporting the size of
+// the datagram on top of the payload.
+func BenchmarkDirectData(b *testing.B) {
+	registerMessages()
+	d := dataDirect{Data: make([]byte, 100), Seq: 1, Origin: 2}
+	for _, c := range []struct {
+		name string
+		m    interface{}
+	}{{"gob", d}, {"opaque", dataOpaque{d}}} {
+		b.Run(c.name, func(b *testing.B) {
+			r := response{to: testAddr(2), m: c.m}
+			clock := newTestClock()
+			drops := &dropCounters{}
+			var overhead int
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf, ok := encodeResponse(r, maxDatagram, clock, framing{},
+					drops)
+				if !ok {
+					b.Fatal("not encoded")
+				}
+				if _, err := decodePeerRequest(buf); err != nil {
+					b.Fatal(err)
+				}
+				overhead = len(buf) - len(d.Data)
+			}
+			b.ReportMetric(float64(overhead), "overhead-bytes")
+		})
+	}
+}
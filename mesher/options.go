@@ -0,0 +1,103 @@
+package mesher
+
+import (
+	"slices"
+	"time"
+)
+
+/******************************************************************************/
+/* SEND OPTIONS                                                               */
+/******************************************************************************/
+
+// Which peers a send reaches, see SendOptions.
+type Route int
+
+const (
+	// Direct where possible, relayed otherwise, unless PeerConfig.NoRelay.
+	RouteDefault Route = iota
+	// Only peers reachable directly.
+	RouteDirectOnly
+	// Direct where possible, relayed only to peers that failed to answer
+	// keep-alives for a while. Skips peers whose direct path is still being
+	// tried.
+	RoutePreferDirect
+	// Direct where possible, relayed otherwise, even with NoRelay.
+	RouteAny
+)
+
+// Per-send policy, see PeerHandle.SendWith. The zero value sends like the
+// broadcast channel.
+type SendOptions struct {
+	Route Route
+	// Datagrams still queued after TTL are dropped. Zero for no limit.
+	TTL time.Duration
+	// Datagrams of higher priority overtake queued ones of lower priority
+	// to the same destination, and are dropped last when the queue is full.
+	Priority int
+	// Logical stream to send on, for receivers to tell apart and subscribe
+	// to, see PeerHandle.Subscribe. Zero is the stream of plain broadcasts,
+	// 0xffff is reserved for gossip.
+	Stream uint16
+}
+
+// Whether data to a goes out, and whether directly.
+func (p *peer) route(a address, r Route) (send bool, direct bool) {
+	direct = p.direct(a)
+	if direct {
+		return true, true
+	}
+	if p.detached {
+		// The server forgot the peer, see PeerConfig.BootstrapPeers.
+		return false, false
+	}
+	switch r {
+	case RouteDirectOnly:
+		return false, false
+	case RoutePreferDirect:
+		_, relayOnly := p.relayOnly[a]
+		return relayOnly, false
+	case RouteAny:
+		return true, false
+	}
+	return !p.config.NoRelay, false
+}
+
+// Queues r behind the responses of at least its priority. A full queue
+// drops its oldest response of the lowest priority.
+func enqueue(q []response, r response, capacity int) ([]response, *response) {
+	var dropped *response
+	if len(q) >= capacity {
+		i := 0
+		for j, m := range q {
+			if m.priority < q[i].priority {
+				i = j
+			}
+		}
+		if q[i].priority > r.priority {
+			return q, &r
+		}
+		dropped = &q[i]
+		q = slices.Delete(slices.Clone(q), i, i+1)
+	}
+	i := len(q)
+	for i > 0 && q[i-1].priority < r.priority {
+		i -= 1
+	}
+	return slices.Insert(q, i, r), dropped
+}
+
+// Sends data like the broadcast channel, with per-send routing, expiry and
+// priority.
+func (h *PeerHandle) SendWith(data []byte, opts SendOptions) error {
+	o := outgoing{buf: data, ttl: opts.TTL, route: opts.Route,
+		priority: opts.Priority, stream: opts.Stream}
+	if o.stream == gossipStream {
+		return ErrReservedStream
+	}
+	select {
+	case h.sends <- o:
+		return nil
+	case <-h.stopped:
+		return ErrStopped
+	}
+}
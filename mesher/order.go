@@ -0,0 +1,110 @@
+package mesher
+
+import (
+	"maps"
+	"slices"
+)
+
+/******************************************************************************/
+/* ORDERING                                                                   */
+/******************************************************************************/
+
+// Data from one source held back until the gap before it is filled, see
+// PeerConfig.ReorderWindow.
+type reorder struct {
+	next    uint64
+	pending map[uint64]PeerMsg
+}
+
+// Hands over the pending data starting at next, up to the first gap.
+func (r *reorder) release(p *peer, data chan PeerMsg) {
+	for {
+		m, ok := r.pending[r.next]
+		if !ok {
+			return
+		}
+		delete(r.pending, r.next)
+		r.next += 1
+		p.handOver(m, data)
+	}
+}
+
+// Hands over all pending data in order, skipping any gaps.
+func (r *reorder) flush(p *peer, data chan PeerMsg) {
+	seqs := make([]uint64, 0, len(r.pending))
+	for seq, _ := range r.pending {
+		seqs = append(seqs, seq)
+	}
+	slices.Sort(seqs)
+	for _, seq := range seqs {
+		p.handOver(r.pending[seq], data)
+		r.next = seq + 1
+	}
+	clear(r.pending)
+}
+
+// Delivers data with sequence number seq from a, in order if a reorder
+// window is configured. Zero is data of peers that do not number it.
+func (p *peer) deliver(a address, seq uint64, m PeerMsg, data chan PeerMsg) {
+	window := uint64(p.config.ReorderWindow)
+	if window == 0 || seq == 0 {
+		p.handOver(m, data)
+		return
+	}
+	r, ok := p.reorders[a]
+	if !ok {
+		r = &reorder{next: seq, pending: make(map[uint64]PeerMsg)}
+		p.reorders[a] = r
+	}
+	if seq < r.next {
+		if seq != 1 {
+			p.logDebug("dropping late data", seq, "from", addrFromKey(a))
+			return
+		}
+		// Numbering starts at one, the sender started over.
+		r.flush(p, data)
+		r.next = seq
+	}
+	r.pending[seq] = m
+	r.release(p, data)
+	for uint64(len(r.pending)) > window {
+		// Give up on the gap.
+		r.next = slices.Min(slices.Collect(maps.Keys(r.pending)))
+		r.release(p, data)
+	}
+}
+
+// Passes data to the application, unless its stream is not subscribed or
+// PeerConfig.Filter rejects it.
+func (p *peer) handOver(m PeerMsg, data chan PeerMsg) {
+	if m.Stream == gossipStream {
+		p.gossipReceived(p.addressOf(m.PeerId), m, data)
+		return
+	}
+	if !p.subscribed(m.Stream) {
+		p.drops.filtered.Add(1)
+		return
+	}
+	if p.config.Filter != nil && !p.config.Filter(m.PeerId, m.Buf) {
+		p.logDebug("dropping data from", m.PeerId, "rejected by the filter")
+		p.drops.filtered.Add(1)
+		return
+	}
+	p.recvIndex += 1
+	m.RecvIndex = p.recvIndex
+	p.remember(m)
+	if p.config.EchoPeer {
+		p.echoBack(m)
+	}
+	data <- m
+	p.drops.queues.data.observe(len(data))
+}
+
+// Hands over everything still held back, called on every tick.
+func (p *peer) flushReorders(data chan PeerMsg) {
+	for a, r := range p.reorders {
+		if _, ok := p.peerIds[a]; ok {
+			r.flush(p, data)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package mesher
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+/******************************************************************************/
+/* PADDING                                                                    */
+/******************************************************************************/
+
+// Appended to the codec of padded data, see PeerConfig.PadTo. The data is
+// prefixed by its length and followed by zeros.
+const padSuffix = "+pad"
+
+const padPrefixSize = 4
+
+// Bytes a datagram of data adds to the padded payload at most, with
+// relaying, sealing and end-to-end encryption, see PeerConfig.PadTo.
+const padOverhead = 512
+
+// Pads data to a encoded with codec to PadTo bytes, unless it does not
+// fit.
+func (p *peer) pad(a address, buf []byte, codec string) ([]byte, string) {
+	if p.config.PadTo <= 0 || len(buf)+padPrefixSize > p.config.PadTo ||
+		!p.supports(a, capPadding) {
+		return buf, codec
+	}
+	padded := make([]byte, p.config.PadTo)
+	binary.BigEndian.PutUint32(padded, uint32(len(buf)))
+	copy(padded[padPrefixSize:], buf)
+	return padded, codec + padSuffix
+}
+
+// Strips the padding, if codec says there is any, returning the codec the
+// data is encoded with.
+func unpad(buf []byte, codec string) ([]byte, string, error) {
+	if !strings.HasSuffix(codec, padSuffix) {
+		return buf, codec, nil
+	}
+	codec = strings.TrimSuffix(codec, padSuffix)
+	if len(buf) < padPrefixSize {
+		return nil, codec, errors.New("truncated padding")
+	}
+	n := binary.BigEndian.Uint32(buf)
+	if uint64(n) > uint64(len(buf)-padPrefixSize) {
+		return nil, codec, errors.New("padded length exceeds data")
+	}
+	return buf[padPrefixSize : padPrefixSize+int(n)], codec, nil
+}
@@ -0,0 +1,149 @@
+package mesher
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+/******************************************************************************/
+/* PCAP                                                                       */
+/******************************************************************************/
+
+// Link type of raw IP packets, either version.
+const pcapLinkRaw = 101
+
+// Records datagrams in pcap format, with made up IP and UDP headers, see
+// PeerConfig.PcapWriter. Nil records nothing.
+type pcapWriter struct {
+	logger
+	mu     sync.Mutex
+	w      io.Writer
+	clock  Clock
+	failed bool
+}
+
+func newPcapWriter(w io.Writer, clock Clock, l logger) *pcapWriter {
+	if w == nil {
+		return nil
+	}
+	c := &pcapWriter{logger: l, w: w, clock: clock}
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], maxMessageSize+60)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkRaw)
+	c.write(header)
+	return c
+}
+
+func (c *pcapWriter) write(b []byte) {
+	if c.failed {
+		return
+	}
+	_, err := c.w.Write(b)
+	if err != nil {
+		c.logError("cannot write pcap, no longer recording:", err)
+		c.failed = true
+	}
+}
+
+// Records buf as received on conn from from.
+func (c *pcapWriter) received(conn Transport, from *net.UDPAddr, buf []byte) {
+	if c != nil {
+		c.record(unmapped(from), localAddrPort(conn), buf)
+	}
+}
+
+// Records buf as sent on conn to to.
+func (c *pcapWriter) sent(conn Transport, to *net.UDPAddr, buf []byte) {
+	if c != nil {
+		c.record(localAddrPort(conn), unmapped(to), buf)
+	}
+}
+
+func (c *pcapWriter) record(src, dst netip.AddrPort, buf []byte) {
+	packet := ipPacket(src, dst, buf)
+	now := c.clock.Now()
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(packet)))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.write(append(header, packet...))
+}
+
+// An IP packet carrying buf from src to dst in a UDP datagram. The packet
+// takes the family of the remote, specified, address. A local address of
+// the other family, e.g. that of a dual-stack socket, is replaced by the
+// unspecified address of the right one.
+func ipPacket(src, dst netip.AddrPort, buf []byte) []byte {
+	srcAddr, dstAddr := src.Addr().Unmap(), dst.Addr().Unmap()
+	v4 := dstAddr.Is4()
+	if !dstAddr.IsValid() || dstAddr.IsUnspecified() {
+		v4 = srcAddr.Is4()
+	}
+	family := func(a netip.Addr) netip.Addr {
+		if a.IsValid() && a.Is4() == v4 {
+			return a
+		}
+		if v4 {
+			return netip.IPv4Unspecified()
+		}
+		return netip.IPv6Unspecified()
+	}
+	srcAddr, dstAddr = family(srcAddr), family(dstAddr)
+	udp := make([]byte, 8, 8+len(buf))
+	binary.BigEndian.PutUint16(udp[0:], src.Port())
+	binary.BigEndian.PutUint16(udp[2:], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(buf)))
+	udp = append(udp, buf...)
+	s, d := srcAddr.AsSlice(), dstAddr.AsSlice()
+	// The pseudo header of the checksum.
+	pseudo := slices.Concat(s, d, []byte{0, 17}, udp[4:6])
+	sum := checksum(append(pseudo, udp...))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	if !v4 {
+		ip := make([]byte, 40, 40+len(udp))
+		ip[0] = 6 << 4
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+		ip[6] = 17
+		ip[7] = 64
+		copy(ip[8:], s)
+		copy(ip[24:], d)
+		return append(ip, udp...)
+	}
+	ip := make([]byte, 20, 20+len(udp))
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+	ip[8] = 64
+	ip[9] = 17
+	copy(ip[12:], s)
+	copy(ip[16:], d)
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+	return append(ip, udp...)
+}
+
+// The internet checksum of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
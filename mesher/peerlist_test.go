@@ -0,0 +1,21 @@
+package mesher
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestOnPeerListReportsOthersUnmapped(t *testing.T) {
+	var reported []netip.AddrPort
+	p := testPeer(PeerConfig{OnPeerList: func(addrs []netip.AddrPort) {
+		reported = addrs
+	}})
+	own, other := addrKey(testAddr(1)), addrKey(testAddr(2))
+	m := peerList{Addresses: []address{own, other}, Version: ProtocolVersion}
+	m.updatePeer(p, testAddr(0), p.responses, p.data)
+	want := []netip.AddrPort{testAddr(2).AddrPort()}
+	if !slices.Equal(reported, want) {
+		t.Errorf("reported %v, want %v", reported, want)
+	}
+}
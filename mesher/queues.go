@@ -0,0 +1,69 @@
+package mesher
+
+import "sync/atomic"
+
+/******************************************************************************/
+/* QUEUES                                                                     */
+/******************************************************************************/
+
+// Capacity of the channels between the goroutines of a node.
+const channelCapacity = 64
+
+// Depth of an internal queue, see Stats.Queues.
+type QueueDepth struct {
+	// Queued right now.
+	Depth int
+	// Most ever queued.
+	HighWater int
+}
+
+// Depths of the internal queues of a node. Servers have no Data and
+// Broadcast queues.
+type Queues struct {
+	// Received datagrams awaiting processing.
+	Requests QueueDepth
+	// Datagrams to send, before the send queues.
+	Responses QueueDepth
+	// Data awaiting the application.
+	Data QueueDepth
+	// Data the application broadcasts.
+	Broadcast QueueDepth
+}
+
+type queueGauge struct {
+	depth func() int
+	high  atomic.Int64
+}
+
+// Called with the depth including an element just queued or taken. A
+// sender blocked on the full channel may count as well, hence the cap.
+func (g *queueGauge) observe(n int) {
+	n = min(n, channelCapacity)
+	for {
+		high := g.high.Load()
+		if int64(n) <= high || g.high.CompareAndSwap(high, int64(n)) {
+			return
+		}
+	}
+}
+
+func (g *queueGauge) snapshot() QueueDepth {
+	d := QueueDepth{HighWater: int(g.high.Load())}
+	if g.depth != nil {
+		d.Depth = g.depth()
+	}
+	return d
+}
+
+type queueGauges struct {
+	requests, responses, data, broadcast queueGauge
+}
+
+func (q *queueGauges) snapshot() Queues {
+	return Queues{
+		Requests:  q.requests.snapshot(),
+		Responses: q.responses.snapshot(),
+		Data:      q.data.snapshot(),
+		Broadcast: q.broadcast.snapshot(),
+	}
+}
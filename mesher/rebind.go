@@ -0,0 +1,134 @@
+package mesher
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+/******************************************************************************/
+/* REBIND                                                                     */
+/******************************************************************************/
+
+// Consecutive socket errors after which the socket is rebound.
+const rebindAfterFailures = 3
+
+// A Transport that replaces its socket with a fresh one on an ephemeral
+// port, once reads or writes keep failing, e.g. after the network changed.
+// Every rebind is announced on rebound.
+type rebindingConn struct {
+	logger
+	mu       sync.Mutex
+	conn     *net.UDPConn
+	laddr    *net.UDPAddr
+	network  string
+	failures int
+	closed   bool
+	rebound  chan netip.AddrPort
+	// Applies the socket options to fresh sockets, if set.
+	prepare func(*net.UDPConn)
+}
+
+func newRebindingConn(conn *net.UDPConn, network string,
+	l logger) *rebindingConn {
+	laddr := *conn.LocalAddr().(*net.UDPAddr)
+	laddr.Port = 0
+	return &rebindingConn{
+		logger:  l,
+		conn:    conn,
+		laddr:   &laddr,
+		network: network,
+		rebound: make(chan netip.AddrPort, 1),
+	}
+}
+
+func (c *rebindingConn) current() *net.UDPConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+func (c *rebindingConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *rebindingConn) succeeded(conn *net.UDPConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn == c.conn {
+		c.failures = 0
+	}
+}
+
+func (c *rebindingConn) failed(conn *net.UDPConn, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || conn != c.conn {
+		return
+	}
+	c.failures += 1
+	c.logWarn("socket error", c.failures, "of", rebindAfterFailures, err)
+	if c.failures < rebindAfterFailures {
+		return
+	}
+	fresh, err := net.ListenUDP(c.network, c.laddr)
+	if err != nil {
+		c.logError("cannot rebind socket:", err)
+		return
+	}
+	c.logInfo("rebinding socket from", c.conn.LocalAddr(), "to",
+		fresh.LocalAddr())
+	if c.prepare != nil {
+		c.prepare(fresh)
+	}
+	c.conn.Close()
+	c.conn = fresh
+	c.failures = 0
+	select {
+	case <-c.rebound:
+	default:
+	}
+	c.rebound <- fresh.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func (c *rebindingConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		conn := c.current()
+		n, from, err := conn.ReadFromUDP(b)
+		if err == nil {
+			return n, from, nil
+		}
+		if c.isClosed() {
+			return n, from, err
+		}
+		c.failed(conn, err)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Only successful writes reset the failure count, as a socket on a dead
+// network may still time out reads without reporting an error.
+func (c *rebindingConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	conn := c.current()
+	n, err := conn.WriteToUDP(b, addr)
+	if err != nil {
+		c.failed(conn, err)
+	} else {
+		c.succeeded(conn)
+	}
+	return n, err
+}
+
+func (c *rebindingConn) LocalAddr() net.Addr {
+	return c.current().LocalAddr()
+}
+
+func (c *rebindingConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return c.conn.Close()
+}
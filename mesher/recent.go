@@ -0,0 +1,38 @@
+package mesher
+
+import "slices"
+
+/******************************************************************************/
+/* RECENT                                                                     */
+/******************************************************************************/
+
+// Keeps a copy of m, about to be handed to the application, in the ring of
+// the last PeerConfig.RecentMessages.
+func (p *peer) remember(m PeerMsg) {
+	if p.config.RecentMessages <= 0 {
+		return
+	}
+	// The application will own m.Buf.
+	m.Buf = slices.Clone(m.Buf)
+	if len(p.recent) < p.config.RecentMessages {
+		p.recent = append(p.recent, m)
+		return
+	}
+	p.recent[p.recentNext] = m
+	p.recentNext = (p.recentNext + 1) % len(p.recent)
+}
+
+// The last data handed to the application, oldest first, see
+// PeerConfig.RecentMessages. Empty once the peer stopped.
+func (h *PeerHandle) RecentMessages() []PeerMsg {
+	var recent []PeerMsg
+	h.do(func(p *peer) {
+		recent = make([]PeerMsg, 0, len(p.recent))
+		for i := range p.recent {
+			m := p.recent[(p.recentNext+i)%len(p.recent)]
+			m.Buf = slices.Clone(m.Buf)
+			recent = append(recent, m)
+		}
+	})
+	return recent
+}
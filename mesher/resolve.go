@@ -0,0 +1,77 @@
+package mesher
+
+import (
+	"net"
+	"time"
+)
+
+/******************************************************************************/
+/* RESOLVE                                                                    */
+/******************************************************************************/
+
+// Resolves the server names again every interval, if positive, and when
+// asked on resolve, until the peer stopped. Changed addresses are handed
+// to sealing and to the peer goroutine, so DNS-based failover reaches the
+// new address.
+func resolveServers(names []string, servers []*net.UDPAddr, network string,
+	interval time.Duration, clock Clock, resolve chan struct{}, s *sealing,
+	commands chan func(*peer), stopped chan struct{}, l logger) {
+	current := make([]*net.UDPAddr, len(servers))
+	copy(current, servers)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = clock.Tick(interval)
+	}
+	go func() {
+		defer live()()
+		for {
+			select {
+			case <-tick:
+			case <-resolve:
+			case <-stopped:
+				l.logDebug("resolveServers shutting down")
+				return
+			}
+			for i, name := range names {
+				a, err := net.ResolveUDPAddr(network, name)
+				if err != nil {
+					l.logWarn("cannot resolve server", name, err)
+					continue
+				}
+				if addrKey(a) == addrKey(current[i]) {
+					continue
+				}
+				l.logInfo("server", name, "moved from", current[i], "to", a)
+				s.replace(current[i], a)
+				current[i] = a
+				i := i
+				select {
+				case commands <- func(p *peer) { p.resolved(i, a) }:
+				case <-stopped:
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Called with the new address of the i-th server.
+func (p *peer) resolved(i int, a *net.UDPAddr) {
+	if addrKey(p.server) == addrKey(p.servers[i]) {
+		p.server = a
+		p.serverSince = p.config.Clock.Now()
+		clear(p.relayTokens)
+		p.cookie = 0
+		p.register(p.responses)
+	}
+	p.servers[i] = a
+}
+
+// Asks for the server names to be resolved again, e.g. as the server
+// stopped answering.
+func (p *peer) reresolve() {
+	select {
+	case p.resolve <- struct{}{}:
+	default:
+	}
+}
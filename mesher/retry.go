@@ -0,0 +1,144 @@
+package mesher
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/******************************************************************************/
+/* RETRY                                                                      */
+/******************************************************************************/
+
+// How long failed writes wait before the next attempt, and how often each
+// is attempted at most.
+const (
+	retryDelay    = 50 * time.Millisecond
+	retryAttempts = 3
+)
+
+// A ring of writes that failed for a momentarily full socket, see
+// PeerConfig.RetryBuffer. The writer puts them, retrying hands them back.
+type retryBuffer struct {
+	logger
+	mu     sync.Mutex
+	ring   []response
+	head   int
+	n      int
+	closed bool
+	drops  *dropCounters
+	// Signalled when the buffer turns non-empty.
+	wake chan struct{}
+}
+
+func newRetryBuffer(capacity int, drops *dropCounters,
+	l logger) *retryBuffer {
+	if capacity <= 0 {
+		return nil
+	}
+	return &retryBuffer{
+		logger: l,
+		ring:   make([]response, capacity),
+		drops:  drops,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Whether err is likely gone once the socket drained.
+func transient(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EWOULDBLOCK) ||
+		errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// Takes m, whose write failed with err, for another attempt. Returns false
+// if it does not, e.g. for lasting errors.
+func (b *retryBuffer) retry(m response, err error) bool {
+	if b == nil || !transient(err) || m.retries >= retryAttempts {
+		return false
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return false
+	}
+	m.retries += 1
+	var dropped *response
+	if b.n == len(b.ring) {
+		oldest := b.ring[b.head]
+		dropped = &oldest
+		b.head = (b.head + 1) % len(b.ring)
+		b.n -= 1
+	}
+	b.ring[(b.head+b.n)%len(b.ring)] = m
+	b.n += 1
+	b.mu.Unlock()
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	if dropped != nil {
+		b.logWarn("retry buffer full, dropping", messageName(dropped.m),
+			"to", dropped.to)
+		b.drops.retryOverflow.Add(1)
+		dropped.written(ErrDropped)
+	}
+	return true
+}
+
+// Empties the buffer, oldest first.
+func (b *retryBuffer) take() []response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ms := make([]response, 0, b.n)
+	for ; b.n > 0; b.n -= 1 {
+		ms = append(ms, b.ring[b.head])
+		b.ring[b.head] = response{}
+		b.head = (b.head + 1) % len(b.ring)
+	}
+	return ms
+}
+
+// Passes responses from in on to the writer, and the failed writes again
+// after retryDelay. Without a buffer, the writer reads in directly.
+func retrying(in chan response, b *retryBuffer, clock Clock) chan response {
+	if b == nil {
+		return in
+	}
+	out := make(chan response)
+	go func() {
+		defer live()()
+		var due <-chan time.Time
+		for in != nil {
+			select {
+			case m, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				out <- m
+			case <-b.wake:
+				if due == nil {
+					due = clock.After(retryDelay)
+				}
+			case <-due:
+				due = nil
+				for _, m := range b.take() {
+					out <- m
+				}
+			}
+		}
+		b.mu.Lock()
+		b.closed = true
+		b.mu.Unlock()
+		for _, m := range b.take() {
+			m.written(ErrDropped)
+		}
+		b.logDebug("retrying shutting down, closing 'out'-channel")
+		close(out)
+	}()
+	return out
+}
@@ -0,0 +1,103 @@
+package mesher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"log"
+	"net"
+	"slices"
+	"sync"
+)
+
+/******************************************************************************/
+/* SEALING                                                                    */
+/******************************************************************************/
+
+// Encrypts datagrams exchanged with the server, see ServerKey. A peer seals
+// only its traffic with servers, the server all of its traffic.
+type sealing struct {
+	logger
+	aead    cipher.AEAD
+	mu      sync.Mutex
+	servers []*net.UDPAddr
+}
+
+// Nil without a key.
+func newSealing(key []byte, servers []*net.UDPAddr, l logger) *sealing {
+	if len(key) == 0 {
+		return nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Fatal("server key: ", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Fatal("server key: ", err)
+	}
+	return &sealing{logger: l, aead: aead, servers: slices.Clone(servers)}
+}
+
+func (s *sealing) applies(addr *net.UDPAddr) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.servers) == 0 {
+		return true
+	}
+	for _, server := range s.servers {
+		if addrKey(addr) == addrKey(server) {
+			return true
+		}
+	}
+	return false
+}
+
+// Seals traffic with to rather than from, once a server moved there.
+func (s *sealing) replace(from, to *net.UDPAddr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, server := range s.servers {
+		if addrKey(server) == addrKey(from) {
+			s.servers[i] = to
+		}
+	}
+}
+
+// Prepends a random nonce to the sealed buf.
+func (s *sealing) seal(buf []byte) []byte {
+	nonce := make([]byte, s.aead.NonceSize(),
+		s.aead.NonceSize()+len(buf)+s.aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		log.Fatal("nonce:", err)
+	}
+	return s.aead.Seal(nonce, nonce, buf, nil)
+}
+
+// Opens buf if it comes from where traffic is sealed.
+func (s *sealing) unseal(buf []byte, from *net.UDPAddr) ([]byte, bool) {
+	if !s.applies(from) {
+		return buf, true
+	}
+	buf, ok := s.open(buf)
+	if !ok {
+		s.logWarn("dropping datagram failing to open from", from)
+	}
+	return buf, ok
+}
+
+func (s *sealing) open(buf []byte) ([]byte, bool) {
+	if len(buf) < s.aead.NonceSize() {
+		return nil, false
+	}
+	nonce := buf[:s.aead.NonceSize()]
+	plain, err := s.aead.Open(nil, nonce, buf[s.aead.NonceSize():], nil)
+	return plain, err == nil
+}
@@ -0,0 +1,25 @@
+package mesher
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestServerDataOnlyFromRegistered(t *testing.T) {
+	var from []netip.AddrPort
+	s := testServer(ServerConfig{OnServerData: func(a netip.AddrPort,
+		data []byte) {
+		from = append(from, a)
+	}})
+	s.track(addrKey(testAddr(1)))
+	serverData{[]byte("x")}.updateServer(s, testAddr(1), s.responses)
+	serverData{[]byte("x")}.updateServer(s, testAddr(2), s.responses)
+	want := []netip.AddrPort{testAddr(1).AddrPort()}
+	if !slices.Equal(from, want) {
+		t.Errorf("server data from %v, want %v", from, want)
+	}
+	if n := s.drops.unregistered.Load(); n != 1 {
+		t.Errorf("counted %d unregistered, want 1", n)
+	}
+}
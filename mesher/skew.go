@@ -0,0 +1,55 @@
+package mesher
+
+import "time"
+
+/******************************************************************************/
+/* CLOCK SKEW                                                                 */
+/******************************************************************************/
+
+// Estimated from the timestamps of a keep-alive and its answer, as in NTP.
+type clockSkew struct {
+	// Add to our clock to get the peer's.
+	offset time.Duration
+	// Round trip, less the time the peer took to answer.
+	delay time.Duration
+}
+
+// The peer's clock in the units of the timestamps exchanged.
+func (p *peer) timestamp() int64 {
+	return p.config.Clock.Now().UnixNano()
+}
+
+// Estimates the skew to a from the answer m to a keep-alive.
+func (p *peer) measureSkew(a address, m isAlive) {
+	if m.Echo == 0 || m.Received == 0 {
+		return
+	}
+	t1, t2, t3, t4 := m.Echo, m.Received, m.Sent, p.timestamp()
+	delay := time.Duration((t4 - t1) - (t3 - t2))
+	if delay < 0 {
+		return
+	}
+	p.skews[a] = clockSkew{
+		offset: time.Duration(((t2 - t1) + (t3 - t4)) / 2),
+		delay:  delay,
+	}
+}
+
+// The estimated offset of the clock of the peer with peerId to ours, to be
+// added to our clock to get theirs. False for unknown ids, for peers yet to
+// answer a keep-alive and once the peer stopped.
+func (h *PeerHandle) ClockOffset(peerId uint64) (time.Duration, bool) {
+	var offset time.Duration
+	found := false
+	h.do(func(p *peer) {
+		for a, id := range p.peerIds {
+			if id == peerId {
+				var s clockSkew
+				s, found = p.skews[a]
+				offset = s.offset
+				return
+			}
+		}
+	})
+	return offset, found
+}
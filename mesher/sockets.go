@@ -0,0 +1,100 @@
+package mesher
+
+import (
+	"log"
+	"net"
+	"sync"
+)
+
+/******************************************************************************/
+/* SOCKETS                                                                    */
+/******************************************************************************/
+
+// Several sockets of one server, see ServerConfig.Addresses. Shared by the
+// readers, which note the socket each peer is heard on, and the stage in
+// front of the writers, which sends replies out that socket, so NAT
+// mappings stay valid.
+type serverSockets struct {
+	mu sync.Mutex
+	// Index of the socket each peer was last heard on, the first if absent.
+	last map[address]int
+}
+
+func newServerSockets() *serverSockets {
+	return &serverSockets{last: make(map[address]int)}
+}
+
+func (s *serverSockets) forget(a address) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.last, a)
+}
+
+// Merges the requests read from each socket, until all are closed.
+func (s *serverSockets) inbound(ins []chan request) chan request {
+	out := make(chan request, channelCapacity)
+	var wg sync.WaitGroup
+	for i, in := range ins {
+		wg.Add(1)
+		go func() {
+			defer live()()
+			defer wg.Done()
+			for r := range in {
+				s.mu.Lock()
+				if i == 0 {
+					delete(s.last, addrKey(r.from))
+				} else {
+					s.last[addrKey(r.from)] = i
+				}
+				s.mu.Unlock()
+				out <- r
+			}
+		}()
+	}
+	go func() {
+		defer live()()
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// Splits responses by the socket to send them out of.
+func (s *serverSockets) outbound(in chan response, n int) []chan response {
+	outs := make([]chan response, n)
+	for i := range outs {
+		outs[i] = make(chan response, channelCapacity)
+	}
+	go func() {
+		defer live()()
+		for m := range in {
+			i := 0
+			if m.to != nil {
+				s.mu.Lock()
+				i = s.last[addrKey(m.to)]
+				s.mu.Unlock()
+			}
+			outs[i] <- m
+		}
+		for _, out := range outs {
+			close(out)
+		}
+	}()
+	return outs
+}
+
+func listenServer(network, address string) Transport {
+	a, err := net.ResolveUDPAddr(network,
+		completeAddress(address, defaultServerPort))
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := net.ListenUDP(network, a)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return conn
+}
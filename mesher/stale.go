@@ -0,0 +1,49 @@
+package mesher
+
+/******************************************************************************/
+/* STALE                                                                      */
+/******************************************************************************/
+
+// Called when a timed out. With DeadAfter set, a turns stale: it keeps its
+// id, but gets no data until it answers again.
+func (p *peer) timedOut(a address) {
+	if p.config.DeadAfter <= 0 {
+		return
+	}
+	if _, ok := p.peerIds[a]; !ok || p.isStale(a) {
+		return
+	}
+	p.logInfo("peer stale", addrFromKey(a))
+	p.stale[a] = p.config.Clock.Now()
+}
+
+// Called when a dropped off the peer list while its direct path is down.
+// Stale peers stay until DeadAfter, the others are forgotten.
+func (p *peer) unlisted(a address) {
+	if !p.isStale(a) {
+		p.forgetPeer(a)
+	}
+}
+
+// Called when a answered a keep-alive.
+func (p *peer) revived(a address) {
+	if _, ok := p.stale[a]; ok {
+		p.logInfo("stale peer back", addrFromKey(a))
+		delete(p.stale, a)
+	}
+}
+
+func (p *peer) isStale(a address) bool {
+	_, ok := p.stale[a]
+	return ok
+}
+
+// Forgets peers stale for DeadAfter.
+func (p *peer) expireStale() {
+	for a, since := range p.stale {
+		if p.config.Clock.Now().Sub(since) >= p.config.DeadAfter {
+			p.logInfo("stale peer dead", addrFromKey(a))
+			p.forgetPeer(a)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package mesher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimedOutPeersTurnStale(t *testing.T) {
+	clock := newTestClock()
+	p := testPeer(PeerConfig{Clock: clock, DeadAfter: time.Minute})
+	a := addrKey(testAddr(2))
+	id := p.testLearn(testAddr(2))
+	p.timedOut(a)
+	if !p.isStale(a) {
+		t.Fatalf("timed out peer not stale")
+	}
+	p.broadcast(outgoing{buf: []byte("data")}, p.responses)
+	if sent := p.testSent(); len(sent) != 0 {
+		t.Errorf("sent %d datagrams to a stale peer", len(sent))
+	}
+
+	m := peerList{Version: ProtocolVersion}
+	m.updatePeer(p, testAddr(0), p.responses, p.data)
+	if p.peerIds[a] != id {
+		t.Errorf("stale peer lost its id once unlisted")
+	}
+	clock.Advance(time.Minute)
+	p.expireStale()
+	if _, ok := p.peerIds[a]; ok {
+		t.Errorf("stale peer kept past DeadAfter")
+	}
+}
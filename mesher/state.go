@@ -0,0 +1,101 @@
+package mesher
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+)
+
+/******************************************************************************/
+/* STATE                                                                      */
+/******************************************************************************/
+
+// What a restarted peer resumes with, see PeerHandle.ExportState.
+type peerState struct {
+	Origin     uint64
+	NextPeerId uint64
+	Peers      []knownPeer
+}
+
+type knownPeer struct {
+	Address address
+	Id      uint64
+	Name    string
+	Alive   bool
+}
+
+// The identity of the peer and the peers it knows, for PeerWithState to
+// resume with after a restart. Nil once the peer stopped.
+func (h *PeerHandle) ExportState() []byte {
+	var buf []byte
+	h.do(func(p *peer) {
+		s := peerState{Origin: p.origin, NextPeerId: p.nextPeerId}
+		for a, id := range p.peerIds {
+			_, alive := p.alivePeers[a]
+			s.Peers = append(s.Peers, knownPeer{a, id, p.names[a], alive})
+		}
+		var b bytes.Buffer
+		err := gob.NewEncoder(&b).Encode(s)
+		if err != nil {
+			log.Fatal("encode state:", err)
+		}
+		buf = b.Bytes()
+	})
+	return buf
+}
+
+// Starts a peer like PeerWithConfig, resuming the identity and peers of
+// state from ExportState. It keeps alive the peers alive at the export right
+// away, while the server refreshes the peer set. Empty or invalid state is
+// ignored.
+func PeerWithState(config PeerConfig, state []byte) *PeerHandle {
+	h := PeerWithConfig(config)
+	if len(state) == 0 {
+		return h
+	}
+	var s peerState
+	err := decode(state, &s)
+	if err != nil {
+		logger{config.LogLevel}.logWarn("ignoring state:", err)
+		return h
+	}
+	h.do(func(p *peer) { p.restore(s) })
+	return h
+}
+
+func (p *peer) restore(s peerState) {
+	if s.Origin != 0 {
+		p.origin = s.Origin
+	}
+	p.nextPeerId = max(p.nextPeerId, s.NextPeerId)
+	used := make(map[uint64]struct{})
+	for _, id := range p.peerIds {
+		used[id] = struct{}{}
+	}
+	for _, k := range s.Peers {
+		if _, ok := p.self[k.Address]; ok {
+			continue
+		}
+		if _, ok := p.peerIds[k.Address]; ok {
+			continue
+		}
+		id := k.Id
+		if _, ok := used[id]; ok {
+			id = p.nextPeerId
+		}
+		p.nextPeerId = max(p.nextPeerId, id+1)
+		used[id] = struct{}{}
+		p.peerIds[k.Address] = id
+		p.names[k.Address] = k.Name
+		p.joined(k.Address)
+		if !k.Alive {
+			continue
+		}
+		p.responses <- response{
+			to: addrFromKey(k.Address),
+			m:  p.keepAliveFor(k.Address),
+		}
+	}
+	p.logInfo("resumed with", len(s.Peers), "known peers")
+	p.register(p.responses)
+}
@@ -0,0 +1,57 @@
+package mesher
+
+/******************************************************************************/
+/* STREAMS                                                                    */
+/******************************************************************************/
+
+// Whether data on stream is handed over.
+func (p *peer) subscribed(stream uint16) bool {
+	if !p.selecting {
+		return true
+	}
+	_, ok := p.streams[stream]
+	return ok
+}
+
+// Hands over only data on the subscribed streams from now on, see
+// SendOptions.Stream. Data on other streams is dropped before it reaches
+// the data channel, and counted as Filtered.
+func (h *PeerHandle) Subscribe(streams ...uint16) error {
+	ok := h.do(func(p *peer) {
+		p.selecting = true
+		for _, s := range streams {
+			p.streams[s] = struct{}{}
+		}
+	})
+	if !ok {
+		return ErrStopped
+	}
+	return nil
+}
+
+// Drops streams from the subscriptions. Once none are left, no data is
+// handed over until SubscribeAll or Subscribe.
+func (h *PeerHandle) Unsubscribe(streams ...uint16) error {
+	ok := h.do(func(p *peer) {
+		for _, s := range streams {
+			delete(p.streams, s)
+		}
+	})
+	if !ok {
+		return ErrStopped
+	}
+	return nil
+}
+
+// Drops all subscriptions and hands over data on all streams again, as
+// before the first Subscribe.
+func (h *PeerHandle) SubscribeAll() error {
+	ok := h.do(func(p *peer) {
+		p.selecting = false
+		clear(p.streams)
+	})
+	if !ok {
+		return ErrStopped
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package mesher
+
+import "testing"
+
+func TestUnsubscribingLastStreamHandsOverNothing(t *testing.T) {
+	p := testPeer(PeerConfig{})
+	commands := make(chan func(*peer))
+	go func() {
+		for f := range commands {
+			f(p)
+		}
+	}()
+	defer close(commands)
+	h := &PeerHandle{commands: commands, stopped: make(chan struct{})}
+
+	if !p.subscribed(1) {
+		t.Fatal("stream 1 not handed over without subscriptions")
+	}
+	h.Subscribe(1)
+	h.Unsubscribe(1)
+	if p.subscribed(1) || p.subscribed(2) {
+		t.Error("streams handed over after unsubscribing the last one")
+	}
+	h.SubscribeAll()
+	if !p.subscribed(2) {
+		t.Error("stream 2 not handed over after SubscribeAll")
+	}
+}
@@ -0,0 +1,254 @@
+package mesher_test
+
+import (
+	"fmt"
+	"mesher/mesher"
+	"mesher/mesher/meshertest"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Transport whose writes block while stalled, like a socket whose send
+// buffer is full.
+type stallingConn struct {
+	*meshertest.Conn
+	mu      sync.Mutex
+	stalled chan struct{}
+}
+
+func (c *stallingConn) stall() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stalled = make(chan struct{})
+}
+
+func (c *stallingConn) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.stalled)
+	c.stalled = nil
+}
+
+func (c *stallingConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	c.mu.Lock()
+	stalled := c.stalled
+	c.mu.Unlock()
+	if stalled != nil {
+		<-stalled
+	}
+	return c.Conn.WriteToUDP(b, addr)
+}
+
+// A Transport keeping the first datagram written.
+type recordingConn struct {
+	*meshertest.Conn
+	first chan []byte
+}
+
+func (c *recordingConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case c.first <- slices.Clone(b):
+	default:
+	}
+	return c.Conn.WriteToUDP(b, addr)
+}
+
+// Fails the test unless f returns within d.
+func within(t testing.TB, d time.Duration, what string, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatal(what, "blocked for", d)
+	}
+}
+
+// Steps clock until every done channel closed, failing the test after 10s.
+func awaitDone(t testing.TB, clock *meshertest.Clock,
+	dones ...<-chan struct{}) {
+	t.Helper()
+	within(t, 10*time.Second, "shutting down", func() {
+		for _, done := range dones {
+			for wait := true; wait; {
+				select {
+				case <-done:
+					wait = false
+				case <-time.After(10 * time.Millisecond):
+					clock.Advance(time.Second)
+				}
+			}
+		}
+	})
+}
+
+// A peer whose socket stopped sending keeps handing over what it receives
+// and taking data to send, while both are flooded.
+func TestStalledSocket(t *testing.T) {
+	network := meshertest.NewNetwork()
+	clock := meshertest.NewClock()
+	serverConn := network.Listen()
+	server := mesher.ServerWithConfig(mesher.ServerConfig{
+		Transport: serverConn,
+		Clock:     clock,
+	})
+	stalling := &stallingConn{Conn: network.Listen()}
+	a := mesher.PeerWithConfig(mesher.PeerConfig{
+		ServerAddress: serverConn.LocalAddr().String(),
+		Transport:     stalling,
+		Clock:         clock,
+	})
+	bConn := network.Listen()
+	b := mesher.PeerWithConfig(mesher.PeerConfig{
+		ServerAddress: serverConn.LocalAddr().String(),
+		Transport:     bConn,
+		Clock:         clock,
+	})
+	step := func() {
+		clock.Advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+	direct := func(h *mesher.PeerHandle) bool {
+		peers := h.Peers()
+		return len(peers) == 1 && peers[0].Direct
+	}
+	for i := 0; i < 20 && !(direct(a) && direct(b)); i++ {
+		step()
+	}
+	if !direct(a) || !direct(b) {
+		t.Fatal("peers did not connect")
+	}
+
+	stalling.stall()
+	const flood = 5000
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < flood; i++ {
+			a.Broadcast([]byte(fmt.Sprint("from a ", i)))
+		}
+	}()
+	stop := make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				b.Broadcast([]byte(fmt.Sprint("from b ", i)))
+			}
+		}
+	}()
+	_, aDone, aIncoming := a.Channels()
+	_, bDone, bIncoming := b.Channels()
+	within(t, 10*time.Second, "receiving", func() {
+		for received := 0; received < 100; received++ {
+			<-aIncoming
+		}
+	})
+	close(stop)
+	go func() {
+		for range aIncoming {
+		}
+	}()
+	go func() {
+		for range bIncoming {
+		}
+	}()
+	within(t, 10*time.Second, "broadcasting", func() { <-sent })
+	within(t, time.Second, "Stats", func() { a.Stats() })
+	if a.Stats().Drops.QueueFull == 0 {
+		t.Error("no datagrams dropped from the full send queue")
+	}
+
+	stalling.release()
+	stalling.Close()
+	bConn.Close()
+	serverConn.Close()
+	awaitDone(t, clock, aDone, bDone, server.Done())
+}
+
+// A server whose socket stopped sending keeps serving commands while
+// flooded with requests from many sources, and times them all out.
+func TestStalledServer(t *testing.T) {
+	network := meshertest.NewNetwork()
+	clock := meshertest.NewClock()
+	stalling := &stallingConn{Conn: network.Listen()}
+	server := mesher.ServerWithConfig(mesher.ServerConfig{
+		Transport: stalling,
+		Clock:     clock,
+	})
+	step := func() {
+		clock.Advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A genuine request, replayed below from many sources.
+	recording := &recordingConn{network.Listen(), make(chan []byte, 1)}
+	peer := mesher.PeerWithConfig(mesher.PeerConfig{
+		ServerAddress: stalling.LocalAddr().String(),
+		Transport:     recording,
+		Clock:         clock,
+	})
+	var request []byte
+	within(t, 10*time.Second, "recording a request", func() {
+		for request == nil {
+			select {
+			case request = <-recording.first:
+			case <-time.After(10 * time.Millisecond):
+				clock.Advance(time.Second)
+			}
+		}
+	})
+	recording.Close()
+	_, peerDone, _ := peer.Channels()
+	awaitDone(t, clock, peerDone)
+
+	stalling.stall()
+	const sources = 100
+	to := stalling.LocalAddr().(*net.UDPAddr)
+	var flood []*meshertest.Conn
+	for i := 0; i < sources; i++ {
+		flood = append(flood, network.Listen())
+	}
+	// More requests per source than fit its send queue.
+	handled := server.Stats().Messages["getPeerList"]
+	for round := 0; round < 100; round++ {
+		for _, c := range flood {
+			c.WriteToUDP(request, to)
+		}
+		handled += sources
+		within(t, 5*time.Second, "handling requests", func() {
+			for server.Stats().Messages["getPeerList"] < handled {
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+	if server.ReadyPeers() == 0 {
+		t.Fatal("flood did not reach the server")
+	}
+	if server.Stats().Drops.QueueFull == 0 {
+		t.Error("no datagrams dropped from the full send queue")
+	}
+
+	// Every source times out while the socket is still stalled.
+	for _, c := range flood {
+		c.Close()
+	}
+	within(t, 10*time.Second, "timing out the flood", func() {
+		for server.ReadyPeers() > 0 {
+			step()
+		}
+	})
+
+	stalling.release()
+	stalling.Close()
+	awaitDone(t, clock, server.Done())
+}
@@ -0,0 +1,33 @@
+package mesher
+
+import "testing"
+
+func TestEvictsLeastRecentlySeen(t *testing.T) {
+	s := testServer(ServerConfig{MaxTrackedPeers: 2})
+	for _, i := range []int{1, 2, 1, 3} {
+		m := getPeerList{Version: ProtocolVersion}
+		s.process(serverMessage{testAddr(i), m, encodedSize(m)})
+	}
+	for i, want := range map[int]bool{1: true, 2: false, 3: true} {
+		if _, ok := s.peers[addrKey(testAddr(i))]; ok != want {
+			t.Errorf("peer %v tracked %v, want %v", testAddr(i), ok, want)
+		}
+	}
+	if s.byRecency.Len() != 2 || len(s.recency) != 2 {
+		t.Errorf("%d peers by recency, %d indexed, want 2", s.byRecency.Len(),
+			len(s.recency))
+	}
+}
+
+// Sources that are not tracked are not watched either.
+func TestUntrackedNotWatched(t *testing.T) {
+	s := testServer(ServerConfig{AmplificationLimit: 3})
+	for i := 1; i <= 100; i++ {
+		m := getPeerList{Version: ProtocolVersion}
+		s.process(serverMessage{testAddr(i), m, encodedSize(m)})
+	}
+	if len(s.seen) != 0 || len(s.peers) != 0 {
+		t.Errorf("%d unvalidated sources watched, %d tracked", len(s.seen),
+			len(s.peers))
+	}
+}
@@ -0,0 +1,126 @@
+package mesher
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"sync"
+)
+
+/******************************************************************************/
+/* TYPES                                                                      */
+/******************************************************************************/
+
+// A value of a type not registered with RegisterType was to be sent.
+var ErrUnregisteredType = errors.New("mesher: unregistered type")
+
+// Application types registered with RegisterType, by gob name.
+var types = struct {
+	sync.Mutex
+	byName map[string]reflect.Type
+}{byName: make(map[string]reflect.Type)}
+
+// Registers the type of v for BroadcastValue and DecodeValue. Exits, if
+// another type was registered under the same name or the name is taken by
+// one of mesher's messages. Registering a type again is fine.
+func RegisterType(v interface{}) {
+	registerMessages()
+	t := reflect.TypeOf(v)
+	name := typeName(t)
+	types.Lock()
+	defer types.Unlock()
+	if known, ok := types.byName[name]; ok {
+		if known != t {
+			log.Fatalf("register type: %v and %v are both named %q", known,
+				t, name)
+		}
+		return
+	}
+	if isMessageName(name) {
+		log.Fatalf("register type: %q is taken by a mesher message", name)
+	}
+	// Gob does not tell a type from pointers to it.
+	for _, known := range types.byName {
+		if baseType(known) == baseType(t) {
+			log.Fatalf("register type: %v is already registered as %v", t,
+				known)
+		}
+	}
+	gob.Register(v)
+	types.byName[name] = t
+}
+
+// The names of the types registered with RegisterType, sorted.
+func RegisteredTypes() []string {
+	types.Lock()
+	defer types.Unlock()
+	names := make([]string, 0, len(types.byName))
+	for name := range types.byName {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// The name gob.Register registers t under.
+func typeName(t reflect.Type) string {
+	if t.Name() == "" || t.PkgPath() == "" {
+		return t.String()
+	}
+	return t.PkgPath() + "." + t.Name()
+}
+
+func baseType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+func isMessageName(name string) bool {
+	for _, m := range messages {
+		if typeName(reflect.TypeOf(m)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeValue(v interface{}) ([]byte, error) {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return nil, fmt.Errorf("%w: nil", ErrUnregisteredType)
+	}
+	types.Lock()
+	known := types.byName[typeName(t)] == t
+	types.Unlock()
+	if !known {
+		return nil, fmt.Errorf("%w: %v", ErrUnregisteredType, t)
+	}
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Decodes the value of a registered type sent with BroadcastValue.
+func DecodeValue(buf []byte) (interface{}, error) {
+	var v interface{}
+	err := decode(buf, &v)
+	return v, err
+}
+
+// Broadcasts v, which must be of a type registered with RegisterType.
+func (h *PeerHandle) BroadcastValue(v interface{}) error {
+	buf, err := encodeValue(v)
+	if err != nil {
+		return err
+	}
+	return h.Broadcast(buf)
+}
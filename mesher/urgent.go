@@ -0,0 +1,48 @@
+package mesher
+
+import (
+	"math"
+	"slices"
+	"time"
+)
+
+/******************************************************************************/
+/* URGENT KEEP-ALIVES                                                         */
+/******************************************************************************/
+
+// Delay after a tick of the extra keep-alives to peers close to timing out.
+const urgentDelay = 1500 * time.Millisecond
+
+// Urgent keep-alives overtake data queued to the same peer.
+const urgentPriority = math.MaxInt32
+
+// Sends an extra keep-alive to the alive peers that answered none for half
+// of PeerTimeout, most overdue first, so a single lost keep-alive or
+// answer does not time them out. Skipped while idle.
+func (p *peer) urgentKeepAlive(responses chan response) {
+	if p.idleInterval > 0 {
+		return
+	}
+	now := p.config.Clock.Now()
+	var urgent []address
+	for a, _ := range p.alivePeers {
+		d, ok := p.paths[a]
+		if !ok || now.Sub(d.answered) < p.config.PeerTimeout/2 ||
+			now.Sub(p.lastPing[a]) < urgentDelay {
+			continue
+		}
+		urgent = append(urgent, a)
+	}
+	slices.SortFunc(urgent, func(a, b address) int {
+		return p.paths[a].answered.Compare(p.paths[b].answered)
+	})
+	for _, a := range urgent {
+		p.logDebug("Sending urgent keep alive to", addrFromKey(a))
+		p.lastPing[a] = now
+		responses <- response{
+			to:       addrFromKey(a),
+			m:        p.keepAliveFor(a),
+			priority: urgentPriority,
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package mesher
+
+import (
+	"net"
+)
+
+/******************************************************************************/
+/* VERSION                                                                    */
+/******************************************************************************/
+
+// Version of the wire protocol, carried by the messages peers register and
+// keep alive with. Nodes only talk to nodes of the same version. Zero is
+// the version of nodes predating versioning.
+const ProtocolVersion = 1
+
+// Whether a message of version from from may be processed.
+func (p *peer) versionOK(from *net.UDPAddr, version int) bool {
+	if version == ProtocolVersion {
+		return true
+	}
+	p.logWarn("ignoring", from, "speaking protocol version", version)
+	if p.config.OnVersionMismatch != nil {
+		p.config.OnVersionMismatch(unmapped(from), version)
+	}
+	return false
+}
+
+func (s *server) versionOK(from *net.UDPAddr, version int) bool {
+	if version == ProtocolVersion {
+		return true
+	}
+	s.logWarn("ignoring", from, "speaking protocol version", version)
+	if s.config.OnVersionMismatch != nil {
+		s.config.OnVersionMismatch(unmapped(from), version)
+	}
+	return false
+}